@@ -0,0 +1,119 @@
+package reversetunnel
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	_API_LIST_SLAVERS = iota
+	_API_KICK_SLAVER
+	_API_LIST_TUNNELS
+	_API_GET_TUNNEL
+	_API_DELETE_TUNNEL
+	_API_CLOSE_CONN
+)
+
+type slaverInfo struct {
+	Name       string    `json:"name"`
+	RemoteAddr string    `json:"remote_addr"`
+	JoinTime   time.Time `json:"join_time"`
+	Tunnels    int       `json:"tunnels"`
+}
+
+type tunnelInfo struct {
+	ID         uint32    `json:"id"`
+	Name       string    `json:"name,omitempty"`
+	SlaverName string    `json:"s_name"`
+	MAddr      string    `json:"m_addr,omitempty"`
+	Domains    []string  `json:"domains,omitempty"`
+	SAddr      string    `json:"s_addr"`
+	Network    string    `json:"network"`
+	CreateTime time.Time `json:"create_time"`
+	ConnCount  int       `json:"conn_count"`
+
+	// GET /tunnels/<id> only
+	Conns []*connInfo `json:"conns,omitempty"`
+}
+
+type connInfo struct {
+	Cid        connectionid `json:"cid"`
+	ClientAddr string       `json:"client_addr"`
+	StartTime  time.Time    `json:"start_time"`
+}
+
+// apiReq is a query of the http api. The master passes it on to every
+// slaver agent, which answers or passes it on to one of its tunnels, so
+// replies get one answer per agent.
+type apiReq struct {
+	kind   int
+	name   string
+	tunnel uint32
+	cid    connectionid
+
+	// the master sends the number of answers to expect, and the channel
+	// they are sent to
+	result  chan *apiResult
+	replies chan interface{}
+}
+
+type apiResult struct {
+	n       int
+	replies chan interface{}
+}
+
+func newApiReq(kind int) *apiReq {
+	return &apiReq{kind: kind, result: make(chan *apiResult, 1)}
+}
+
+// wait collects the answers, those not sent in time are left out.
+func (req *apiReq) wait() (answers []interface{}) {
+	timeout := time.After(_NETWORK_TIMEOUT)
+	var res *apiResult
+	select {
+	case res = <-req.result:
+	case <-timeout:
+		return
+	}
+	for i := 0; i < res.n; i++ {
+		select {
+		case a := <-res.replies:
+			answers = append(answers, a)
+		case <-timeout:
+			return
+		}
+	}
+	return
+}
+
+// fanout sends req to every agent, with a channel big enough that nobody
+// blocks on an abandoned request.
+func (req *apiReq) fanout(agents []chan *channelEvent) {
+	replies := make(chan interface{}, len(agents))
+	for _, ch := range agents {
+		sub := *req
+		sub.replies = replies
+		(&channelEvent{_EVENT_SA_API, &sub}).sendTo(ch)
+	}
+	req.result <- &apiResult{len(agents), replies}
+}
+
+// answer replies to the api with a single answer.
+func (req *apiReq) answer(a interface{}) {
+	replies := make(chan interface{}, 1)
+	replies <- a
+	req.result <- &apiResult{1, replies}
+}
+
+var (
+	_TUNNEL_ID      = uint32(0)
+	_TUNNEL_ID_LOCK = sync.Mutex{}
+)
+
+func newTunnelID() uint32 {
+	_TUNNEL_ID_LOCK.Lock()
+	defer _TUNNEL_ID_LOCK.Unlock()
+
+	_TUNNEL_ID += 1
+	return _TUNNEL_ID
+}
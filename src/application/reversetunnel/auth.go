@@ -0,0 +1,200 @@
+package reversetunnel
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+)
+
+const _AUTH_NONCE_LEN = 32
+
+// masterAuth verifies joining slavers, a slaver listed in the authorized
+// keys file signs the challenge with its key, the others prove they know
+// the shared token.
+type masterAuth struct {
+	token    []byte
+	keysFile string
+}
+
+func newMasterAuth(conf *config) *masterAuth {
+	if conf.AuthToken == "" && conf.AuthorizedKeys == "" {
+		return nil
+	}
+	return &masterAuth{
+		token:    []byte(conf.AuthToken),
+		keysFile: conf.AuthorizedKeys,
+	}
+}
+
+// loadAuthorizedKeys reads lines of a slaver name and its base64 encoded
+// ed25519 public key, lines starting with # are comments.
+func loadAuthorizedKeys(file string) (
+	keys map[string]ed25519.PublicKey, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	keys = map[string]ed25519.PublicKey{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, ErrAuthKey
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, ErrAuthKey
+		}
+		keys[fields[0]] = ed25519.PublicKey(key)
+	}
+	return keys, scanner.Err()
+}
+
+// authenticate challenges the slaver name on conn, the keys file is read
+// on every join so that keys can be added without a restart.
+func (a *masterAuth) authenticate(conn net.Conn, name string) (err error) {
+	var pub ed25519.PublicKey
+	if a.keysFile != "" {
+		var keys map[string]ed25519.PublicKey
+		if keys, err = loadAuthorizedKeys(a.keysFile); err != nil {
+			return
+		}
+		pub = keys[name]
+	}
+
+	method := byte(AUTH_METHOD_TOKEN)
+	if pub != nil {
+		method = AUTH_METHOD_ED25519
+	} else if len(a.token) == 0 {
+		return ErrAuthFailed
+	}
+
+	nonce := make([]byte, _AUTH_NONCE_LEN)
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+	buf := new(bytes.Buffer)
+	buf.Write([]byte{PROTO_VER, CMD_V1_AUTH_CHALLENGE, method})
+	buf.Write(nonce)
+	if _, err = conn.Write(buf.Bytes()); err != nil {
+		return
+	}
+
+	var (
+		cmd byte
+		sig []byte
+	)
+	if cmd, err = parseCommandV1(conn); err != nil {
+		return
+	} else if cmd != CMD_V1_AUTH {
+		return ErrCommand
+	}
+	if sig, err = parseAuthV1(conn); err != nil {
+		return
+	}
+
+	msg := append(append([]byte{}, nonce...), name...)
+	if method == AUTH_METHOD_ED25519 {
+		if !ed25519.Verify(pub, msg, sig) {
+			return ErrAuthFailed
+		}
+	} else if !hmac.Equal(sig, tokenMAC(a.token, msg)) {
+		return ErrAuthFailed
+	}
+	return nil
+}
+
+func tokenMAC(token, msg []byte) []byte {
+	mac := hmac.New(sha256.New, token)
+	mac.Write(msg)
+	return mac.Sum(nil)
+}
+
+// slaverCred answers the challenges of the master.
+type slaverCred struct {
+	token []byte
+	key   ed25519.PrivateKey
+}
+
+func newSlaverCred(conf *config) (c *slaverCred, err error) {
+	c = &slaverCred{token: []byte(conf.AuthToken)}
+	if conf.PrivateKey != "" {
+		if c.key, err = loadPrivateKey(conf.PrivateKey); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// loadPrivateKey reads a PKCS #8 pem encoded ed25519 key, as written by
+// "openssl genpkey -algorithm ed25519" or the -genkey flag.
+func loadPrivateKey(file string) (key ed25519.PrivateKey, err error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, ErrAuthKey
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return
+	}
+	key, ok := k.(ed25519.PrivateKey)
+	if !ok {
+		return nil, ErrAuthKey
+	}
+	return key, nil
+}
+
+// sign returns the answer to a challenge, nil when the slaver has no
+// credential for method.
+func (c *slaverCred) sign(method byte, nonce []byte, name string) []byte {
+	msg := append(append([]byte{}, nonce...), name...)
+	switch method {
+	case AUTH_METHOD_TOKEN:
+		if len(c.token) > 0 {
+			return tokenMAC(c.token, msg)
+		}
+	case AUTH_METHOD_ED25519:
+		if c.key != nil {
+			return ed25519.Sign(c.key, msg)
+		}
+	}
+	return nil
+}
+
+// genKey writes a new private key to file and returns the base64 encoded
+// public key for the authorized keys file of the master.
+func genKey(file string) (pub string, err error) {
+	pubKey, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err = ioutil.WriteFile(file, data, 0600); err != nil {
+		return
+	}
+	return base64.StdEncoding.EncodeToString(pubKey), nil
+}
@@ -0,0 +1,153 @@
+package reversetunnel
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+// challenge runs authenticate against a slaver answering with answer, it
+// returns the error of the master.
+func challenge(a *masterAuth, name string,
+	answer func(method byte, nonce []byte) []byte) error {
+	master, slaver := net.Pipe()
+	defer slaver.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		err := a.authenticate(master, name)
+		master.Close()
+		done <- err
+	}()
+
+	if cmd, err := parseCommandV1(slaver); err == nil &&
+		cmd == CMD_V1_AUTH_CHALLENGE {
+		method, nonce, _ := parseAuthChallengeV1(slaver)
+		sig := answer(method, nonce)
+		buf := new(bytes.Buffer)
+		buf.Write([]byte{PROTO_VER, CMD_V1_AUTH, byte(len(sig))})
+		buf.Write(sig)
+		slaver.Write(buf.Bytes())
+	}
+	return <-done
+}
+
+func TestAuthToken(t *testing.T) {
+	a := &masterAuth{token: []byte("secret")}
+	good := &slaverCred{token: []byte("secret")}
+	bad := &slaverCred{token: []byte("guess")}
+
+	if err := challenge(a, "s0", func(m byte, n []byte) []byte {
+		return good.sign(m, n, "s0")
+	}); err != nil {
+		t.Fatalf("right token: %v", err)
+	}
+	if err := challenge(a, "s0", func(m byte, n []byte) []byte {
+		return bad.sign(m, n, "s0")
+	}); err != ErrAuthFailed {
+		t.Fatalf("wrong token: %v", err)
+	}
+	// the mac covers the name
+	if err := challenge(a, "s1", func(m byte, n []byte) []byte {
+		return good.sign(m, n, "s0")
+	}); err != ErrAuthFailed {
+		t.Fatalf("mac of another name: %v", err)
+	}
+}
+
+func TestAuthEd25519(t *testing.T) {
+	pub, key, _ := ed25519.GenerateKey(rand.Reader)
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	keysFile := filepath.Join(t.TempDir(), "authorized_keys")
+	ioutil.WriteFile(keysFile, []byte("# slavers\ns0 "+
+		base64.StdEncoding.EncodeToString(pub)+"\n"), 0600)
+	a := &masterAuth{keysFile: keysFile}
+
+	if err := challenge(a, "s0", func(m byte, n []byte) []byte {
+		if m != AUTH_METHOD_ED25519 {
+			t.Errorf("method %d", m)
+		}
+		return (&slaverCred{key: key}).sign(m, n, "s0")
+	}); err != nil {
+		t.Fatalf("right key: %v", err)
+	}
+	if err := challenge(a, "s0", func(m byte, n []byte) []byte {
+		return (&slaverCred{key: other}).sign(m, n, "s0")
+	}); err != ErrAuthFailed {
+		t.Fatalf("wrong key: %v", err)
+	}
+	// no credential for the method gives an empty signature
+	if err := challenge(a, "s0", func(m byte, n []byte) []byte {
+		return (&slaverCred{token: []byte("secret")}).sign(m, n, "s0")
+	}); err != ErrAuthFailed {
+		t.Fatalf("no key: %v", err)
+	}
+}
+
+func TestAuthReplay(t *testing.T) {
+	pub, key, _ := ed25519.GenerateKey(rand.Reader)
+	keysFile := filepath.Join(t.TempDir(), "authorized_keys")
+	ioutil.WriteFile(keysFile, []byte("s0 "+
+		base64.StdEncoding.EncodeToString(pub)+"\n"), 0600)
+
+	for _, a := range []*masterAuth{
+		{token: []byte("secret")},
+		{keysFile: keysFile},
+	} {
+		cred := &slaverCred{token: []byte("secret"), key: key}
+		var recorded []byte
+		if err := challenge(a, "s0", func(m byte, n []byte) []byte {
+			recorded = cred.sign(m, n, "s0")
+			return recorded
+		}); err != nil {
+			t.Fatal(err)
+		}
+		// every challenge has a new nonce
+		if err := challenge(a, "s0", func(m byte, n []byte) []byte {
+			return recorded
+		}); err != ErrAuthFailed {
+			t.Fatalf("replayed answer: %v", err)
+		}
+	}
+}
+
+func TestAuthUnknownSlaver(t *testing.T) {
+	pub, key, _ := ed25519.GenerateKey(rand.Reader)
+	keysFile := filepath.Join(t.TempDir(), "authorized_keys")
+	ioutil.WriteFile(keysFile, []byte("s0 "+
+		base64.StdEncoding.EncodeToString(pub)+"\n"), 0600)
+
+	// without a token only the listed slavers are challenged
+	a := &masterAuth{keysFile: keysFile}
+	challenged := false
+	if err := challenge(a, "s1", func(m byte, n []byte) []byte {
+		challenged = true
+		return (&slaverCred{key: key}).sign(m, n, "s1")
+	}); err != ErrAuthFailed || challenged {
+		t.Fatalf("unknown slaver: %v, challenged %v", err, challenged)
+	}
+
+	// with a token they fall back to it
+	a.token = []byte("secret")
+	if err := challenge(a, "s1", func(m byte, n []byte) []byte {
+		if m != AUTH_METHOD_TOKEN {
+			t.Errorf("method %d", m)
+		}
+		return (&slaverCred{key: key}).sign(m, n, "s1")
+	}); err != ErrAuthFailed {
+		t.Fatalf("unknown slaver with a key only: %v", err)
+	}
+}
+
+func TestAuthKeysFile(t *testing.T) {
+	keysFile := filepath.Join(t.TempDir(), "authorized_keys")
+	ioutil.WriteFile(keysFile, []byte("s0 not-base64\n"), 0600)
+	if _, err := loadAuthorizedKeys(keysFile); err != ErrAuthKey {
+		t.Fatalf("bad key: %v", err)
+	}
+}
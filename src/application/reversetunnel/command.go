@@ -19,23 +19,7 @@ func parseCommandV1(r io.Reader) (cmd byte, err error) {
 }
 
 func parseJoinV1(r io.Reader) (name string, err error) {
-	buf := make([]byte, 64, 64)
-
-	if _, err = io.ReadFull(r, buf[:1]); err != nil {
-		err = ErrIO
-		return
-	}
-	if buf[0] == 0 || buf[0] > 64 {
-		return "", ErrCommand
-	}
-
-	nameLen := buf[0]
-	if _, err = io.ReadFull(r, buf[:nameLen]); err != nil {
-		err = ErrIO
-		return
-	}
-
-	return string(buf[:nameLen]), nil
+	return parseName(r)
 }
 
 func parseJoinAckV1(r io.Reader) (rep byte, err error) {
@@ -48,45 +32,68 @@ func parseJoinAckV1(r io.Reader) (rep byte, err error) {
 	return buf[0], nil
 }
 
-func parseBuildTunnelV1(r io.Reader) (
-	mAddr, sAddr *address, cid connectionid, err error) {
-	buf := make([]byte, 8, 8)
+// parseAddrV1 reads an ATYP, ADDR and PORT.
+func parseAddrV1(r io.Reader) (addr *address, err error) {
+	buf := make([]byte, 1)
+	addr = new(address)
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return nil, ErrIO
+	}
+	addr.atype = buf[0]
+
+	if addr.atype == ATYP_IPV4 {
+		addr.ip = make([]byte, 4)
+	} else if addr.atype == ATYP_IPV6 {
+		addr.ip = make([]byte, 16)
+	} else if addr.atype != ATYP_DOMAIN {
+		return nil, ErrCommand
+	}
 
-	addrs := []*address{new(address), new(address)}
-	for i := 0; i < 2; i++ {
-		if _, err = io.ReadFull(r, buf[:1]); err != nil {
-			err = ErrIO
-			return
-		} else {
-			if buf[0] == ATYP_IPV4 {
-				addrs[i].ip = make([]byte, 4)
-			} else if buf[0] == ATYP_IPV6 {
-				addrs[i].ip = make([]byte, 16)
-			} else {
-				err = ErrCommand
-				return
-			}
-			if _, err = io.ReadFull(r, addrs[i].ip); err != nil {
-				err = ErrIO
-				return
-			}
-			if _, err = io.ReadFull(r, addrs[i].port[:]); err != nil {
-				err = ErrIO
-				return
-			}
-			addrs[i].atype = buf[0]
+	if addr.ip != nil {
+		if _, err = io.ReadFull(r, addr.ip); err != nil {
+			return nil, ErrIO
 		}
+	} else {
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, ErrIO
+		} else if buf[0] == 0 {
+			return nil, ErrCommand
+		}
+		host := make([]byte, buf[0])
+		if _, err = io.ReadFull(r, host); err != nil {
+			return nil, ErrIO
+		}
+		addr.host = string(host)
+	}
+	if _, err = io.ReadFull(r, addr.port[:]); err != nil {
+		return nil, ErrIO
+	}
+	return
+}
+
+func parseBuildTunnelV1(r io.Reader) (
+	mAddr, sAddr *address, cid connectionid, token []byte, err error) {
+	if mAddr, err = parseAddrV1(r); err != nil {
+		return
+	}
+	if sAddr, err = parseAddrV1(r); err != nil {
+		return
 	}
 	if err = binary.Read(r, binary.BigEndian, &cid); err != nil {
 		err = ErrIO
 		return
 	}
+	token = make([]byte, _TUNNEL_TOKEN_LEN)
+	if _, err = io.ReadFull(r, token); err != nil {
+		err = ErrIO
+		return
+	}
 
-	return addrs[0], addrs[1], cid, nil
+	return
 }
 
 func parseBuildTunnelAckV1(r io.Reader) (
-	name string, cid connectionid, err error) {
+	name string, cid connectionid, token []byte, err error) {
 	buf := make([]byte, 64, 64)
 	if _, err = io.ReadFull(r, buf[:1]); err != nil {
 		err = ErrIO
@@ -107,6 +114,11 @@ func parseBuildTunnelAckV1(r io.Reader) (
 		err = ErrIO
 		return
 	}
+	token = make([]byte, _TUNNEL_TOKEN_LEN)
+	if _, err = io.ReadFull(r, token); err != nil {
+		err = ErrIO
+		return
+	}
 
 	if io.ReadFull(r, buf[:1]); err != nil {
 		err = ErrIO
@@ -118,3 +130,98 @@ func parseBuildTunnelAckV1(r io.Reader) (
 
 	return
 }
+
+func parseAuthChallengeV1(r io.Reader) (method byte, nonce []byte,
+	err error) {
+	buf := make([]byte, 1+_AUTH_NONCE_LEN)
+	if _, err = io.ReadFull(r, buf); err != nil {
+		err = ErrIO
+		return
+	}
+	return buf[0], buf[1:], nil
+}
+
+func parseAuthV1(r io.Reader) (sig []byte, err error) {
+	buf := make([]byte, 0xff)
+	if _, err = io.ReadFull(r, buf[:1]); err != nil {
+		err = ErrIO
+		return
+	}
+
+	sigLen := buf[0]
+	if _, err = io.ReadFull(r, buf[:sigLen]); err != nil {
+		err = ErrIO
+		return
+	}
+	return buf[:sigLen], nil
+}
+
+// parseName reads a NAME.LEN and NAME.
+func parseName(r io.Reader) (name string, err error) {
+	buf := make([]byte, 64)
+	if _, err = io.ReadFull(r, buf[:1]); err != nil {
+		return "", ErrIO
+	} else if buf[0] == 0 || buf[0] > 64 {
+		return "", ErrCommand
+	}
+
+	nameLen := buf[0]
+	if _, err = io.ReadFull(r, buf[:nameLen]); err != nil {
+		return "", ErrIO
+	}
+	return string(buf[:nameLen]), nil
+}
+
+func parseServicesV1(r io.Reader) (services []*service, err error) {
+	buf := make([]byte, 3)
+	if _, err = io.ReadFull(r, buf[:1]); err != nil {
+		err = ErrIO
+		return
+	}
+
+	count := int(buf[0])
+	for i := 0; i < count; i++ {
+		s := new(service)
+		if s.name, err = parseName(r); err != nil {
+			return
+		}
+		if _, err = io.ReadFull(r, buf); err != nil {
+			err = ErrIO
+			return
+		}
+		if buf[0] != SERVICE_NET_TCP && buf[0] != SERVICE_NET_UDP {
+			err = ErrCommand
+			return
+		}
+		s.udp = buf[0] == SERVICE_NET_UDP
+		s.mPort = binary.BigEndian.Uint16(buf[1:])
+		if s.sAddr, err = parseAddrV1(r); err != nil {
+			return
+		}
+		services = append(services, s)
+	}
+	return
+}
+
+func parseServicesAckV1(r io.Reader) (acks []*serviceAck, err error) {
+	buf := make([]byte, 1)
+	if _, err = io.ReadFull(r, buf); err != nil {
+		err = ErrIO
+		return
+	}
+
+	count := int(buf[0])
+	for i := 0; i < count; i++ {
+		ack := new(serviceAck)
+		if ack.name, err = parseName(r); err != nil {
+			return
+		}
+		if _, err = io.ReadFull(r, buf); err != nil {
+			err = ErrIO
+			return
+		}
+		ack.rep = buf[0]
+		acks = append(acks, ack)
+	}
+	return
+}
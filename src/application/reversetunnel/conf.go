@@ -7,4 +7,37 @@ type config struct {
 	CtrlAddr   string `json:"ctrl_addr,omitempty"`
 	TunnelAddr string `json:"tunnel_addr,omitempty"`
 	JoinAddr   string `json:"join,omitempty"`
+
+	// join authentication, a shared token on both sides, the master also
+	// accepts the slavers listed with their keys in AuthorizedKeys
+	AuthToken      string `json:"auth_token,omitempty"`
+	AuthorizedKeys string `json:"authorized_keys,omitempty"`
+	PrivateKey     string `json:"private_key,omitempty"`
+
+	// master only, tunnels built whenever the slaver of the key joins,
+	// s_name of the tunnels may be left out
+	Tunnels map[string][]*buildTunnelReq `json:"tunnels,omitempty"`
+
+	// master only, seconds a kicked slaver may not join again, a kick
+	// only forces a reconnect when 0
+	KickBan int `json:"kick_ban,omitempty"`
+
+	// master only, host the services advertised by the slavers listen
+	// on, which are refused when empty
+	ServiceHost string `json:"service_host,omitempty"`
+
+	// slaver only, services the master is asked to expose after join
+	Services []*serviceConfig `json:"services,omitempty"`
+
+	// master only, shared ports of the http and https tunnels, routed by
+	// the Host header or the TLS SNI, disabled when empty
+	HTTPAddr  string `json:"http_addr,omitempty"`
+	HTTPSAddr string `json:"https_addr,omitempty"`
+
+	// tls of the ctrl and tunnel channels, plain tcp when nil
+	TLS *tlsConfig `json:"tls,omitempty"`
+
+	// slaver only, carry the tunnel connections as streams of the ctrl
+	// connection instead of dialing the tunnel address
+	Mux bool `json:"mux,omitempty"`
 }
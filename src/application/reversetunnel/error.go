@@ -10,4 +10,23 @@ var (
 	ErrSlaverNotExist     = errors.New("slaver not exist")
 	ErrReply              = errors.New("error reply")
 	ErrIO                 = errors.New("error io")
+	ErrAuthFailed         = errors.New("authentication failed")
+	ErrSlaverKicked       = errors.New("slaver kicked")
+	ErrAuthKey            = errors.New("invalid auth key")
+	ErrTLSConfig          = errors.New("invalid tls config")
+	ErrTLSPin             = errors.New("master certificate not pinned")
+	ErrMuxClosed          = errors.New("mux session closed")
+	ErrStreamReset        = errors.New("stream reset")
+	ErrAddress            = errors.New("invalid address")
+	ErrNetwork            = errors.New("unknown network")
+	ErrService            = errors.New("invalid or refused service")
+	ErrListen             = errors.New("master cannot listen")
+	ErrTunnelNotExist     = errors.New("tunnel not exist")
+	ErrConnNotExist       = errors.New("conn not exist")
+	ErrTunnelExist        = errors.New("tunnel already exists")
+	ErrRequest            = errors.New("invalid request")
+	ErrTimeout            = errors.New("timeout")
+	ErrDomain             = errors.New("invalid domain")
+	ErrDomainExist        = errors.New("domain already taken")
+	ErrVhost              = errors.New("no vhost listener")
 )
@@ -21,8 +21,30 @@ func Main() {
 	})
 
 	confFile := flag.String("f", "", "config file")
+	keyFile := flag.String("genkey", "",
+		"write a new slaver private key to file, print its public key")
+	pinFile := flag.String("pin", "",
+		"print the pin of the master certificate in file")
 	flag.Parse()
 
+	if *pinFile != "" {
+		if pin, err := certFilePin(*pinFile); err != nil {
+			panic(err)
+		} else {
+			fmt.Println(pin)
+		}
+		return
+	}
+
+	if *keyFile != "" {
+		if pub, err := genKey(*keyFile); err != nil {
+			panic(err)
+		} else {
+			fmt.Println(pub)
+		}
+		return
+	}
+
 	conf := new(config)
 	if data, err := ioutil.ReadFile(*confFile); err != nil {
 		panic(err)
@@ -1,9 +1,11 @@
 package reversetunnel
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/solomonwzs/goxutil/logger"
@@ -11,6 +13,7 @@ import (
 
 type tunnelConnAckReq struct {
 	cid       connectionid
+	token     []byte
 	agentName string
 	net.Conn
 }
@@ -22,7 +25,16 @@ type masterServer struct {
 
 	tunnelAddr *address
 
-	slavers map[string]*slaverAgent
+	slavers     map[string]*slaverAgent
+	tunnels     map[string][]*buildTunnelReq
+	serviceHost string
+	vhosts      map[string]*vhostRouter
+	auth        *masterAuth
+
+	// kicked slavers and when they may join again
+	kickBan  time.Duration
+	kicked   map[string]time.Time
+	kickLock *sync.Mutex
 
 	name string
 	ch   chan *channelEvent
@@ -54,7 +66,40 @@ func newMasterServer(conf *config) *masterServer {
 	}
 	m.tunnel = tunnelListener
 
+	if conf.TLS != nil {
+		tlsConf, err := conf.TLS.serverConfig()
+		if err != nil {
+			panic(err)
+		}
+		m.ctrl = tls.NewListener(m.ctrl, tlsConf)
+		m.tunnel = tls.NewListener(m.tunnel, tlsConf)
+	}
+
+	m.vhosts = map[string]*vhostRouter{}
+	for network, addr := range map[string]string{
+		"http":  conf.HTTPAddr,
+		"https": conf.HTTPSAddr,
+	} {
+		if addr != "" {
+			if m.vhosts[network], err = newVhostRouter(addr,
+				network == "https"); err != nil {
+				panic(err)
+			}
+		}
+	}
+
 	m.slavers = map[string]*slaverAgent{}
+	m.tunnels = conf.Tunnels
+	m.serviceHost = conf.ServiceHost
+	for name, reqs := range m.tunnels {
+		for _, req := range reqs {
+			req.SlaverName = name
+		}
+	}
+	m.auth = newMasterAuth(conf)
+	m.kickBan = time.Duration(conf.KickBan) * time.Second
+	m.kicked = map[string]time.Time{}
+	m.kickLock = &sync.Mutex{}
 	m.name = conf.Name
 	m.ch = make(chan *channelEvent, _CHANNEL_SIZE)
 
@@ -65,6 +110,9 @@ func (m *masterServer) serve() {
 	go http.Serve(m.client, &masterHttp{m.ch})
 	go m.listenSlaverJoin()
 	go m.listenTunnelConn()
+	for _, r := range m.vhosts {
+		go r.serve()
+	}
 
 	for e := range m.ch {
 		switch e.typ {
@@ -73,6 +121,24 @@ func (m *masterServer) serve() {
 			if sa, exist := m.slavers[req.SlaverName]; exist {
 				(&channelEvent{_EVENT_SA_BUILD_TUNNEL_REQ, req}).sendTo(
 					sa.ch)
+			} else {
+				req.reply(nil, ErrSlaverNotExist)
+			}
+		case _EVENT_M_API:
+			req := e.data.(*apiReq)
+			if req.kind == _API_KICK_SLAVER {
+				sa, exist := m.slavers[req.name]
+				if exist {
+					m.kick(req.name)
+					(&channelEvent{_EVENT_SA_SHUTDOWN, nil}).sendTo(sa.ch)
+				}
+				req.answer(exist)
+			} else {
+				agents := []chan *channelEvent{}
+				for _, sa := range m.slavers {
+					agents = append(agents, sa.ch)
+				}
+				req.fanout(agents)
 			}
 		case _EVENT_SA_TERMINATE:
 			name := e.data.(string)
@@ -85,6 +151,10 @@ func (m *masterServer) serve() {
 			m.slavers[sa.name] = sa
 			logger.Infof("master: slaver [%s] join\n", sa.name)
 			go sa.serve()
+			for _, req := range m.tunnels[sa.name] {
+				(&channelEvent{_EVENT_SA_BUILD_TUNNEL_REQ, req}).sendTo(
+					sa.ch)
+			}
 		case _EVENT_M_NEW_SLAVER_CONN_ERR:
 			err := e.data.(error)
 			logger.Infof("master: new slaver error: %s\n", err)
@@ -93,6 +163,8 @@ func (m *masterServer) serve() {
 			if sa, exist := m.slavers[req.agentName]; exist {
 				(&channelEvent{_EVENT_SA_PTUNNEL_CONN_ACK, req}).sendTo(
 					sa.ch)
+			} else if req.Conn != nil {
+				req.Close()
 			}
 		default:
 		}
@@ -104,36 +176,84 @@ func (m *masterServer) listenTunnelConn() {
 		if conn, err := m.tunnel.Accept(); err != nil {
 			logger.Error(err)
 		} else {
-			conn.SetReadDeadline(time.Now().Add(_NETWORK_TIMEOUT))
-			if cmd, err := parseCommandV1(conn); err != nil {
-				logger.Error(err)
-				conn.Close()
-			} else if cmd != CMD_V1_BUILD_TUNNEL_ACK {
-				logger.Error("error: command")
-				conn.Close()
-			} else if name, cid, err := parseBuildTunnelAckV1(
-				conn); err != nil && err != ErrReply {
-				logger.Error(err)
-				conn.Close()
-			} else {
-				conn0 := conn
-				if err == nil {
-					conn.SetReadDeadline(time.Time{})
-				} else {
-					conn.Close()
-					conn0 = nil
-				}
-				req := &tunnelConnAckReq{
-					cid:       cid,
-					agentName: name,
-					Conn:      conn0,
-				}
-				(&channelEvent{_EVENT_M_PTUNNEL_CONN_ACK, req}).sendTo(m.ch)
-			}
+			// the tls handshake of a slow peer must not hold the others
+			go m.handleTunnelConn(conn, "")
+		}
+	}
+}
+
+// acceptMuxStreams takes the streams of a multiplexed slaver as tunnel
+// connections, until the session ends.
+func (m *masterServer) acceptMuxStreams(sess *muxSession, name string) {
+	for {
+		if st, err := sess.Accept(); err != nil {
+			return
+		} else {
+			go m.handleTunnelConn(st, name)
 		}
 	}
 }
 
+// handleTunnelConn reads the build tunnel reply a slaver sends first on a
+// tunnel connection, a stream of a multiplexed slaver must name its own
+// slaver.
+func (m *masterServer) handleTunnelConn(conn net.Conn, slaverName string) {
+	conn.SetReadDeadline(time.Now().Add(_NETWORK_TIMEOUT))
+	if cmd, err := parseCommandV1(conn); err != nil {
+		logger.Error(err)
+		conn.Close()
+	} else if cmd != CMD_V1_BUILD_TUNNEL_ACK {
+		logger.Error("error: command")
+		conn.Close()
+	} else if name, cid, token, err := parseBuildTunnelAckV1(
+		conn); err != nil && err != ErrReply {
+		logger.Error(err)
+		conn.Close()
+	} else if cn, ok := peerName(conn); (ok && cn != name) ||
+		(slaverName != "" && slaverName != name) {
+		logger.Error(ErrAuthFailed)
+		conn.Close()
+	} else {
+		conn0 := conn
+		if err == nil {
+			conn.SetReadDeadline(time.Time{})
+		} else {
+			conn.Close()
+			conn0 = nil
+		}
+		req := &tunnelConnAckReq{
+			cid:       cid,
+			token:     token,
+			agentName: name,
+			Conn:      conn0,
+		}
+		(&channelEvent{_EVENT_M_PTUNNEL_CONN_ACK, req}).sendTo(m.ch)
+	}
+}
+
+// kick refuses the joins of name for kickBan.
+func (m *masterServer) kick(name string) {
+	if m.kickBan <= 0 {
+		return
+	}
+	m.kickLock.Lock()
+	defer m.kickLock.Unlock()
+
+	now := time.Now()
+	for n, until := range m.kicked {
+		if now.After(until) {
+			delete(m.kicked, n)
+		}
+	}
+	m.kicked[name] = now.Add(m.kickBan)
+}
+
+func (m *masterServer) isKicked(name string) bool {
+	m.kickLock.Lock()
+	defer m.kickLock.Unlock()
+	return time.Now().Before(m.kicked[name])
+}
+
 func (m *masterServer) listenSlaverJoin() {
 	for {
 		if conn, err := m.ctrl.Accept(); err != nil {
@@ -164,7 +284,7 @@ func (m *masterServer) startSlaverAgent(conn net.Conn) {
 
 	if cmd, err = parseCommandV1(conn); err != nil {
 		return
-	} else if cmd != CMD_V1_JOIN {
+	} else if cmd != CMD_V1_JOIN && cmd != CMD_V1_JOIN_MUX {
 		err = ErrCommand
 		return
 	}
@@ -174,6 +294,25 @@ func (m *masterServer) startSlaverAgent(conn net.Conn) {
 		return
 	}
 
+	// a verified client certificate names the slaver, no other
+	// authentication is asked
+	if cn, ok := peerName(conn); ok {
+		if cn != name {
+			err = ErrAuthFailed
+		}
+	} else if m.auth != nil {
+		err = m.auth.authenticate(conn, name)
+	}
+	if err != nil {
+		conn.Write([]byte{PROTO_VER, CMD_V1_JOIN_ACK, REP_ERR_AUTH_FAILED})
+		return
+	}
+	if m.isKicked(name) {
+		conn.Write([]byte{PROTO_VER, CMD_V1_JOIN_ACK, REP_ERR_KICKED})
+		err = ErrSlaverKicked
+		return
+	}
+
 	if _, exist := m.slavers[name]; exist {
 		conn.Write([]byte{PROTO_VER, CMD_V1_JOIN_ACK,
 			REP_ERR_DUP_SLAVER_NAME})
@@ -183,6 +322,15 @@ func (m *masterServer) startSlaverAgent(conn net.Conn) {
 			REP_SUCCEEDS}); err != nil {
 			return
 		}
-		sa = newSlaverAgent(name, conn, m.tunnelAddr, m.ch)
+
+		ctrl := conn
+		if cmd == CMD_V1_JOIN_MUX {
+			conn.SetDeadline(time.Time{})
+			sess := newMuxSession(conn, false)
+			go m.acceptMuxStreams(sess, name)
+			ctrl = sess.ctrl
+		}
+		sa = newSlaverAgent(name, ctrl, m.tunnelAddr, m.serviceHost,
+			m.vhosts, m.ch)
 	}
 }
@@ -2,9 +2,16 @@ package reversetunnel
 
 import (
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/solomonwzs/goxutil/logger"
 )
@@ -13,12 +20,89 @@ type buildTunnelReq struct {
 	MAddr      string `json:"m_addr"`
 	SAddr      string `json:"s_addr"`
 	SlaverName string `json:"s_name"`
+
+	// "tcp", "udp", "http" or "https", default "tcp"
+	Network string `json:"network,omitempty"`
+
+	// http and https only, instead of m_addr, host names or wildcards
+	// like "*.example.com" routed to the tunnel
+	Domains []string `json:"domains,omitempty"`
+
+	// service name, for the tunnels advertised by the slaver
+	Name string `json:"name,omitempty"`
+
+	// given by the master
+	ID uint32 `json:"-"`
+
+	// the outcome, for the requests of the http api
+	result chan *buildTunnelResult
+
+	// an http request that timed out abandons the build, unless an agent
+	// took it already
+	taken     bool
+	abandoned bool
+	lock      *sync.Mutex
+}
+
+type buildTunnelResult struct {
+	info *tunnelInfo
+	err  error
+}
+
+// take is called by the agent before it builds the tunnel, false when the
+// http request gave up.
+func (req *buildTunnelReq) take() bool {
+	if req.lock == nil {
+		return true
+	}
+	req.lock.Lock()
+	defer req.lock.Unlock()
+	req.taken = !req.abandoned
+	return req.taken
+}
+
+// abandon gives up the build, false when an agent took it and replies.
+func (req *buildTunnelReq) abandon() bool {
+	req.lock.Lock()
+	defer req.lock.Unlock()
+	req.abandoned = !req.taken
+	return req.abandoned
+}
+
+func (req *buildTunnelReq) reply(info *tunnelInfo, err error) {
+	if req.result != nil {
+		req.result <- &buildTunnelResult{info, err}
+	}
+}
+
+// buildTunnelStatus is the http status of a failed build.
+func buildTunnelStatus(err error) int {
+	if err == ErrSlaverNotExist {
+		return http.StatusNotFound
+	} else if err == ErrTunnelExist || err == ErrDomainExist ||
+		errors.Is(err, syscall.EADDRINUSE) {
+		return http.StatusConflict
+	} else if err == ErrTimeout {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadRequest
+}
+
+type apiError struct {
+	Error string `json:"error"`
 }
 
 type masterHttp struct {
 	masterCh chan *channelEvent
 }
 
+// GET    /slavers
+// DELETE /slavers/<name>
+// GET    /tunnels
+// POST   /tunnels
+// GET    /tunnels/<id>
+// DELETE /tunnels/<id>
+// DELETE /tunnels/<id>/conns/<cid>
 func (m *masterHttp) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	defer func() {
 		if err := recover(); err != nil {
@@ -28,14 +112,42 @@ func (m *masterHttp) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-	if r.URL.Path == "/tunnel" {
-		if r.Method == "POST" {
-			m.buildTunnelHandler(w, r)
-			return
-		}
+	path := r.URL.Path
+	if (path == "/tunnel" || path == "/tunnels") && r.Method == "POST" {
+		m.buildTunnelHandler(w, r)
+	} else if path == "/tunnels" && r.Method == "GET" {
+		m.listTunnelsHandler(w, r)
+	} else if strings.HasPrefix(path, "/tunnels/") {
+		m.tunnelHandler(w, r)
+	} else if path == "/slavers" && r.Method == "GET" {
+		m.listSlaversHandler(w, r)
+	} else if strings.HasPrefix(path, "/slavers/") && r.Method == "DELETE" {
+		m.kickSlaverHandler(w, r)
+	} else {
+		m.indexHandler(w, r)
 	}
+}
 
-	m.indexHandler(w, r)
+func writeJson(w http.ResponseWriter, httpStatus int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		logger.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus)
+	w.Write(data)
+}
+
+func writeError(w http.ResponseWriter, httpStatus int, err error) {
+	writeJson(w, httpStatus, &apiError{err.Error()})
+}
+
+// query sends an api request to the master and waits for the answers.
+func (m *masterHttp) query(req *apiReq) []interface{} {
+	(&channelEvent{_EVENT_M_API, req}).sendTo(m.masterCh)
+	return req.wait()
 }
 
 func (m *masterHttp) indexHandler(w http.ResponseWriter, r *http.Request) (
@@ -47,27 +159,141 @@ func (m *masterHttp) indexHandler(w http.ResponseWriter, r *http.Request) (
 func (m *masterHttp) buildTunnelHandler(w http.ResponseWriter,
 	r *http.Request) (httpStatus int) {
 
-	httpStatus = http.StatusOK
-	rep := []byte{}
-	defer func() {
-		w.WriteHeader(httpStatus)
-		w.Write(rep)
-	}()
-
 	req := new(buildTunnelReq)
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		logger.Error(err)
 		httpStatus = http.StatusInternalServerError
+		w.WriteHeader(httpStatus)
 		return
 	}
 
 	if err = json.Unmarshal(body, req); err != nil {
 		logger.Error(err)
 		httpStatus = http.StatusBadRequest
+		writeError(w, httpStatus, err)
+		return
+	} else if req.SAddr == "" || req.SlaverName == "" ||
+		(req.MAddr == "" && len(req.Domains) == 0) {
+		httpStatus = http.StatusBadRequest
+		writeError(w, httpStatus, ErrRequest)
 		return
 	}
+	req.ID = newTunnelID()
+	req.result = make(chan *buildTunnelResult, 1)
+	req.lock = &sync.Mutex{}
 	(&channelEvent{_EVENT_M_BUILD_TUNNEL_REQ, req}).sendTo(m.masterCh)
 
+	res := &buildTunnelResult{err: ErrTimeout}
+	select {
+	case res = <-req.result:
+	case <-time.After(_NETWORK_TIMEOUT):
+		if !req.abandon() {
+			res = <-req.result
+		}
+	}
+	if res.err != nil {
+		httpStatus = buildTunnelStatus(res.err)
+		writeError(w, httpStatus, res.err)
+		return
+	}
+
+	httpStatus = http.StatusCreated
+	writeJson(w, httpStatus, res.info)
 	return
 }
+
+func (m *masterHttp) listSlaversHandler(w http.ResponseWriter,
+	r *http.Request) {
+	slavers := []*slaverInfo{}
+	for _, a := range m.query(newApiReq(_API_LIST_SLAVERS)) {
+		if info, ok := a.(*slaverInfo); ok {
+			slavers = append(slavers, info)
+		}
+	}
+	sort.Slice(slavers, func(i, j int) bool {
+		return slavers[i].Name < slavers[j].Name
+	})
+	writeJson(w, http.StatusOK, slavers)
+}
+
+// DELETE /slavers/<name> shuts the agent down, the slaver reconnects
+// unless the kick_ban of the master refuses it for a while.
+func (m *masterHttp) kickSlaverHandler(w http.ResponseWriter,
+	r *http.Request) {
+	req := newApiReq(_API_KICK_SLAVER)
+	req.name = strings.TrimPrefix(r.URL.Path, "/slavers/")
+	if answers := m.query(req); len(answers) == 1 && answers[0] == true {
+		logger.Infof("master: slaver [%s] kicked\n", req.name)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeError(w, http.StatusNotFound, ErrSlaverNotExist)
+}
+
+func (m *masterHttp) listTunnelsHandler(w http.ResponseWriter,
+	r *http.Request) {
+	tunnels := []*tunnelInfo{}
+	for _, a := range m.query(newApiReq(_API_LIST_TUNNELS)) {
+		if infos, ok := a.([]*tunnelInfo); ok {
+			tunnels = append(tunnels, infos...)
+		}
+	}
+	sort.Slice(tunnels, func(i, j int) bool {
+		return tunnels[i].ID < tunnels[j].ID
+	})
+	writeJson(w, http.StatusOK, tunnels)
+}
+
+// GET /tunnels/<id>, DELETE /tunnels/<id>, DELETE /tunnels/<id>/conns/<cid>
+func (m *masterHttp) tunnelHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/tunnels/"), "/")
+	id, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	req := newApiReq(_API_GET_TUNNEL)
+	req.tunnel = uint32(id)
+
+	if len(parts) == 1 && r.Method == "GET" {
+		for _, a := range m.query(req) {
+			if info, ok := a.(*tunnelInfo); ok {
+				sort.Slice(info.Conns, func(i, j int) bool {
+					return info.Conns[i].Cid < info.Conns[j].Cid
+				})
+				writeJson(w, http.StatusOK, info)
+				return
+			}
+		}
+		writeError(w, http.StatusNotFound, ErrTunnelNotExist)
+	} else if len(parts) == 1 && r.Method == "DELETE" {
+		req.kind = _API_DELETE_TUNNEL
+		for _, a := range m.query(req) {
+			if a == true {
+				logger.Infof("master: tunnel %d deleted\n", id)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		writeError(w, http.StatusNotFound, ErrTunnelNotExist)
+	} else if len(parts) == 3 && parts[1] == "conns" &&
+		r.Method == "DELETE" {
+		cid, err := strconv.ParseUint(parts[2], 10, 32)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		req.kind = _API_CLOSE_CONN
+		req.cid = connectionid(cid)
+		for _, a := range m.query(req) {
+			if a == true {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		writeError(w, http.StatusNotFound, ErrConnNotExist)
+	} else {
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
@@ -0,0 +1,172 @@
+package reversetunnel
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTestMaster runs a master on loopback ports, it is never stopped.
+func startTestMaster(kickBan int) (m *masterServer,
+	api string) {
+	m = newMasterServer(&config{
+		Name:       "master",
+		ClientAddr: "127.0.0.1:0",
+		CtrlAddr:   "127.0.0.1:0",
+		TunnelAddr: "127.0.0.1:0",
+		KickBan:    kickBan,
+	})
+	go m.serve()
+	return m, "http://" + m.client.Addr().String()
+}
+
+// join joins the master as name, it returns the ctrl connection and the
+// reply.
+func join(t *testing.T, m *masterServer, name string) (net.Conn, byte) {
+	conn, err := net.Dial("tcp", m.ctrl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(append([]byte{PROTO_VER, CMD_V1_JOIN, byte(len(name))},
+		name...))
+	conn.SetReadDeadline(time.Now().Add(_NETWORK_TIMEOUT))
+	ack := make([]byte, 3)
+	if _, err = io.ReadFull(conn, ack); err != nil {
+		t.Fatal(err)
+	}
+	return conn, ack[2]
+}
+
+func request(t *testing.T, method, url, body string, v interface{}) int {
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		json.NewDecoder(resp.Body).Decode(v)
+	}
+	return resp.StatusCode
+}
+
+func TestMasterHttp(t *testing.T) {
+	m, api := startTestMaster(0)
+	conn, rep := join(t, m, "s0")
+	defer conn.Close()
+	if rep != REP_SUCCEEDS {
+		t.Fatalf("join: %d", rep)
+	}
+
+	var slavers []*slaverInfo
+	for i := 0; i < 50 && len(slavers) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		request(t, "GET", api+"/slavers", "", &slavers)
+	}
+	if len(slavers) != 1 || slavers[0].Name != "s0" {
+		t.Fatalf("slavers: %v", slavers)
+	}
+
+	cases := []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"GET", "/", "", http.StatusOK},
+		{"GET", "/tunnels", "", http.StatusOK},
+		{"POST", "/tunnels", "{", http.StatusBadRequest},
+		{"POST", "/tunnels", `{"s_name":"s0"}`, http.StatusBadRequest},
+		{"POST", "/tunnels", `{"s_name":"s1","m_addr":"127.0.0.1:0",` +
+			`"s_addr":"127.0.0.1:1"}`, http.StatusNotFound},
+		{"GET", "/tunnels/x", "", http.StatusBadRequest},
+		{"GET", "/tunnels/999", "", http.StatusNotFound},
+		{"DELETE", "/tunnels/999", "", http.StatusNotFound},
+		{"DELETE", "/tunnels/999/conns/1", "", http.StatusNotFound},
+		{"DELETE", "/tunnels/999/conns/x", "", http.StatusBadRequest},
+		{"GET", "/tunnels/999/x", "", http.StatusNotFound},
+		{"DELETE", "/slavers/s1", "", http.StatusNotFound},
+	}
+	for _, c := range cases {
+		if status := request(t, c.method, api+c.path, c.body,
+			nil); status != c.status {
+			t.Errorf("%s %s: %d", c.method, c.path, status)
+		}
+	}
+}
+
+func TestMasterKick(t *testing.T) {
+	for _, ban := range []int{0, 60} {
+		m, api := startTestMaster(ban)
+		conn, _ := join(t, m, "s0")
+		defer conn.Close()
+
+		status := 0
+		for i := 0; i < 50 && status != http.StatusNoContent; i++ {
+			time.Sleep(10 * time.Millisecond)
+			status = request(t, "DELETE", api+"/slavers/s0", "", nil)
+		}
+		if status != http.StatusNoContent {
+			t.Fatalf("kick: %d", status)
+		}
+
+		// the ctrl connection is closed by the kick
+		conn.SetReadDeadline(time.Now().Add(_NETWORK_TIMEOUT))
+		if _, err := io.Copy(ioutil.Discard, conn); err != nil {
+			t.Fatalf("ctrl connection after the kick: %v", err)
+		}
+
+		want := byte(REP_SUCCEEDS)
+		if ban > 0 {
+			want = REP_ERR_KICKED
+		}
+		var rep byte = 0xff
+		for i := 0; i < 50; i++ {
+			var c net.Conn
+			if c, rep = join(t, m, "s0"); rep != REP_ERR_DUP_SLAVER_NAME {
+				defer c.Close()
+				break
+			}
+			// the agent may still be leaving
+			c.Close()
+			time.Sleep(10 * time.Millisecond)
+		}
+		if rep != want {
+			t.Fatalf("kick ban %d: join again: %d", ban, rep)
+		}
+	}
+}
+
+func TestBuildTunnelTimeout(t *testing.T) {
+	ch := make(chan *channelEvent, _CHANNEL_SIZE)
+	srv := httptest.NewServer(&masterHttp{ch})
+	defer srv.Close()
+	body := `{"s_name":"s0","m_addr":"127.0.0.1:0","s_addr":"127.0.0.1:1"}`
+
+	// a build the agent takes in time is waited for, even after the timeout
+	go func() {
+		req := (<-ch).data.(*buildTunnelReq)
+		req.take()
+		time.Sleep(_NETWORK_TIMEOUT + 100*time.Millisecond)
+		req.reply(&tunnelInfo{ID: req.ID}, nil)
+	}()
+	if status := request(t, "POST", srv.URL+"/tunnels", body,
+		nil); status != http.StatusCreated {
+		t.Fatalf("build taken before the timeout: %d", status)
+	}
+
+	// a build the agent gets too late is dropped
+	if status := request(t, "POST", srv.URL+"/tunnels", body,
+		nil); status != http.StatusGatewayTimeout {
+		t.Fatalf("build not taken: %d", status)
+	}
+	if req := (<-ch).data.(*buildTunnelReq); req.take() {
+		t.Fatal("abandoned build taken")
+	}
+}
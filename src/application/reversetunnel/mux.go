@@ -0,0 +1,439 @@
+package reversetunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	_MUX_HEADER_LEN     = 7
+	_MUX_MAX_FRAME_DATA = 16 * 1024
+
+	// bytes a stream may receive before its reader catches up
+	_MUX_WINDOW = 256 * 1024
+)
+
+// muxSession carries streams over one connection, see the frame format in
+// protocol.go. Stream 0 exists from the start and carries the ctrl
+// commands, the other streams are opened by Open and Accept.
+type muxSession struct {
+	conn net.Conn
+
+	streams  map[uint32]*muxStream
+	nextID   uint32
+	acceptCh chan *muxStream
+	ctrl     *muxStream
+
+	err       error
+	closed    bool
+	lock      *sync.Mutex
+	writeLock *sync.Mutex
+}
+
+// newMuxSession starts a session on conn, the slaver side opens odd
+// stream ids and the master side even ones.
+func newMuxSession(conn net.Conn, slaver bool) *muxSession {
+	s := &muxSession{
+		conn:      conn,
+		streams:   map[uint32]*muxStream{},
+		nextID:    2,
+		acceptCh:  make(chan *muxStream, _CHANNEL_SIZE),
+		lock:      &sync.Mutex{},
+		writeLock: &sync.Mutex{},
+	}
+	if slaver {
+		s.nextID = 1
+	}
+	s.ctrl = newMuxStream(0, s)
+	s.streams[0] = s.ctrl
+
+	go s.recvFrames()
+	return s
+}
+
+func (s *muxSession) Open() (st *muxStream, err error) {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil, s.err
+	}
+	st = newMuxStream(s.nextID, s)
+	s.streams[st.id] = st
+	s.nextID += 2
+	s.lock.Unlock()
+
+	if err = s.writeFrame(MUX_FRAME_OPEN, st.id, nil); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (s *muxSession) Accept() (*muxStream, error) {
+	if st, ok := <-s.acceptCh; ok {
+		return st, nil
+	}
+	return nil, s.err
+}
+
+func (s *muxSession) Close() error {
+	s.closeWithError(ErrMuxClosed)
+	return nil
+}
+
+func (s *muxSession) closeWithError(err error) {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return
+	}
+	s.closed = true
+	s.err = err
+	streams := s.streams
+	s.streams = map[uint32]*muxStream{}
+	close(s.acceptCh)
+	s.lock.Unlock()
+
+	s.conn.Close()
+	for _, st := range streams {
+		st.abort(err)
+	}
+}
+
+func (s *muxSession) remove(id uint32) {
+	s.lock.Lock()
+	delete(s.streams, id)
+	s.lock.Unlock()
+}
+
+func (s *muxSession) writeFrame(typ byte, id uint32, data []byte) (
+	err error) {
+	buf := make([]byte, _MUX_HEADER_LEN, _MUX_HEADER_LEN+len(data))
+	buf[0] = typ
+	binary.BigEndian.PutUint32(buf[1:], id)
+	binary.BigEndian.PutUint16(buf[5:], uint16(len(data)))
+	buf = append(buf, data...)
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	// as in sendData, a peer taking no frame for that long is dead
+	s.conn.SetWriteDeadline(time.Now().Add(_NETWORK_TIMEOUT))
+	if _, err = s.conn.Write(buf); err != nil {
+		s.closeWithError(err)
+	}
+	return
+}
+
+func (s *muxSession) recvFrames() {
+	header := make([]byte, _MUX_HEADER_LEN)
+	for {
+		if _, err := io.ReadFull(s.conn, header); err != nil {
+			s.closeWithError(err)
+			return
+		}
+		typ := header[0]
+		id := binary.BigEndian.Uint32(header[1:])
+		data := make([]byte, binary.BigEndian.Uint16(header[5:]))
+		if _, err := io.ReadFull(s.conn, data); err != nil {
+			s.closeWithError(err)
+			return
+		}
+
+		s.lock.Lock()
+		st, exist := s.streams[id]
+		if typ == MUX_FRAME_OPEN && !exist && !s.closed &&
+			id%2 != s.nextID%2 {
+			st = newMuxStream(id, s)
+			s.streams[id] = st
+			select {
+			case s.acceptCh <- st:
+			default:
+				// backlog full
+				delete(s.streams, id)
+				st = nil
+				go s.writeFrame(MUX_FRAME_RESET, id, nil)
+			}
+		}
+		s.lock.Unlock()
+		// frames of streams already closed here are dropped
+		if st == nil {
+			continue
+		}
+
+		switch typ {
+		case MUX_FRAME_DATA:
+			if !st.push(data) {
+				s.remove(id)
+				go s.writeFrame(MUX_FRAME_RESET, id, nil)
+			}
+		case MUX_FRAME_WINDOW:
+			if len(data) == 4 {
+				st.addWindow(binary.BigEndian.Uint32(data))
+			}
+		case MUX_FRAME_CLOSE:
+			st.remoteClose()
+		case MUX_FRAME_RESET:
+			s.remove(id)
+			st.abort(ErrStreamReset)
+		}
+	}
+}
+
+// muxStream is a net.Conn, closing stream 0 closes the session.
+type muxStream struct {
+	id   uint32
+	sess *muxSession
+
+	buf        bytes.Buffer
+	recvWindow uint32
+	consumed   uint32
+	sendWindow uint32
+
+	finRecv bool
+	finSent bool
+	closed  bool
+	err     error
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readCh        chan struct{}
+	writeCh       chan struct{}
+	lock          *sync.Mutex
+}
+
+func newMuxStream(id uint32, s *muxSession) *muxStream {
+	return &muxStream{
+		id:         id,
+		sess:       s,
+		recvWindow: _MUX_WINDOW,
+		sendWindow: _MUX_WINDOW,
+		readCh:     make(chan struct{}, 1),
+		writeCh:    make(chan struct{}, 1),
+		lock:       &sync.Mutex{},
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// wait blocks until ch is notified or deadline passes.
+func wait(ch chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-ch
+		return nil
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ch:
+		return nil
+	case <-t.C:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// push queues received data, false when the peer overran the window.
+func (st *muxStream) push(data []byte) bool {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	if uint32(len(data)) > st.recvWindow || st.finRecv {
+		st.err = ErrStreamReset
+		notify(st.readCh)
+		notify(st.writeCh)
+		return false
+	}
+	st.recvWindow -= uint32(len(data))
+	if !st.closed {
+		st.buf.Write(data)
+	}
+	notify(st.readCh)
+	return true
+}
+
+func (st *muxStream) addWindow(n uint32) {
+	st.lock.Lock()
+	st.sendWindow += n
+	st.lock.Unlock()
+	notify(st.writeCh)
+}
+
+func (st *muxStream) remoteClose() {
+	st.lock.Lock()
+	st.finRecv = true
+	st.lock.Unlock()
+	notify(st.readCh)
+}
+
+func (st *muxStream) abort(err error) {
+	st.lock.Lock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.lock.Unlock()
+	notify(st.readCh)
+	notify(st.writeCh)
+}
+
+func (st *muxStream) Read(b []byte) (n int, err error) {
+	for {
+		st.lock.Lock()
+		if st.closed {
+			st.lock.Unlock()
+			return 0, io.ErrClosedPipe
+		} else if st.buf.Len() > 0 {
+			break
+		} else if st.err != nil {
+			err = st.err
+			st.lock.Unlock()
+			return
+		} else if st.finRecv {
+			st.lock.Unlock()
+			return 0, io.EOF
+		}
+		deadline := st.readDeadline
+		st.lock.Unlock()
+
+		if err = wait(st.readCh, deadline); err != nil {
+			return
+		}
+	}
+
+	n, _ = st.buf.Read(b)
+	// give the window back once half of it is read
+	var update uint32
+	st.consumed += uint32(n)
+	if st.consumed >= _MUX_WINDOW/2 {
+		update, st.consumed = st.consumed, 0
+		st.recvWindow += update
+	}
+	if st.buf.Len() > 0 {
+		notify(st.readCh)
+	}
+	st.lock.Unlock()
+
+	if update > 0 {
+		data := make([]byte, 4)
+		binary.BigEndian.PutUint32(data, update)
+		st.sess.writeFrame(MUX_FRAME_WINDOW, st.id, data)
+	}
+	return
+}
+
+func (st *muxStream) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		st.lock.Lock()
+		if st.closed || st.finSent {
+			st.lock.Unlock()
+			return n, io.ErrClosedPipe
+		} else if st.err != nil {
+			err = st.err
+			st.lock.Unlock()
+			return
+		} else if st.sendWindow == 0 {
+			deadline := st.writeDeadline
+			st.lock.Unlock()
+			if err = wait(st.writeCh, deadline); err != nil {
+				return
+			}
+			continue
+		}
+
+		m := len(b)
+		if m > _MUX_MAX_FRAME_DATA {
+			m = _MUX_MAX_FRAME_DATA
+		}
+		if uint32(m) > st.sendWindow {
+			m = int(st.sendWindow)
+		}
+		st.sendWindow -= uint32(m)
+		st.lock.Unlock()
+
+		if err = st.sess.writeFrame(MUX_FRAME_DATA, st.id, b[:m]); err != nil {
+			return
+		}
+		n += m
+		b = b[m:]
+	}
+	return
+}
+
+// CloseWrite sends a close frame, the peer reads EOF after the data
+// already sent.
+func (st *muxStream) CloseWrite() error {
+	st.lock.Lock()
+	if st.closed || st.finSent || st.err != nil {
+		st.lock.Unlock()
+		return nil
+	}
+	st.finSent = true
+	st.lock.Unlock()
+	notify(st.writeCh)
+	return st.sess.writeFrame(MUX_FRAME_CLOSE, st.id, nil)
+}
+
+// Close ends the stream, gracefully when the peer already closed its side,
+// with a reset otherwise.
+func (st *muxStream) Close() error {
+	if st.id == 0 {
+		return st.sess.Close()
+	}
+
+	st.lock.Lock()
+	if st.closed {
+		st.lock.Unlock()
+		return nil
+	}
+	st.closed = true
+	send, typ := st.err == nil, byte(MUX_FRAME_RESET)
+	if st.finRecv {
+		send, typ = send && !st.finSent, MUX_FRAME_CLOSE
+	}
+	st.buf.Reset()
+	st.lock.Unlock()
+	notify(st.readCh)
+	notify(st.writeCh)
+
+	st.sess.remove(st.id)
+	if send {
+		st.sess.writeFrame(typ, st.id, nil)
+	}
+	return nil
+}
+
+func (st *muxStream) LocalAddr() net.Addr  { return st.sess.conn.LocalAddr() }
+func (st *muxStream) RemoteAddr() net.Addr { return st.sess.conn.RemoteAddr() }
+
+func (st *muxStream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *muxStream) SetReadDeadline(t time.Time) error {
+	st.lock.Lock()
+	st.readDeadline = t
+	st.lock.Unlock()
+	notify(st.readCh)
+	return nil
+}
+
+func (st *muxStream) SetWriteDeadline(t time.Time) error {
+	st.lock.Lock()
+	st.writeDeadline = t
+	st.lock.Unlock()
+	notify(st.writeCh)
+	return nil
+}
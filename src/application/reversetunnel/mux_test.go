@@ -0,0 +1,157 @@
+package reversetunnel
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// muxPair returns the slaver and master sessions of a pipe.
+func muxPair() (slaver, master *muxSession) {
+	c, s := net.Pipe()
+	return newMuxSession(c, true), newMuxSession(s, false)
+}
+
+// openStream opens a stream on slaver and accepts it on master.
+func openStream(t *testing.T, slaver, master *muxSession) (
+	*muxStream, *muxStream) {
+	st, err := slaver.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := master.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st, peer
+}
+
+func TestMuxWindow(t *testing.T) {
+	slaver, master := muxPair()
+	defer slaver.Close()
+	defer master.Close()
+	st, peer := openStream(t, slaver, master)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), _MUX_WINDOW/16*2)
+	written := make(chan error, 1)
+	go func() {
+		_, err := st.Write(data)
+		written <- err
+	}()
+
+	// the writer stops once the window is used up
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case err := <-written:
+		t.Fatalf("wrote twice the window without a reader: %v", err)
+	default:
+	}
+	st.lock.Lock()
+	sendWindow := st.sendWindow
+	st.lock.Unlock()
+	if sendWindow != 0 {
+		t.Fatalf("send window %d left", sendWindow)
+	}
+
+	// and resumes once the reader gives the window back
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(peer, got); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("data changed")
+	}
+}
+
+func TestMuxReset(t *testing.T) {
+	slaver, master := muxPair()
+	defer slaver.Close()
+	defer master.Close()
+	st, peer := openStream(t, slaver, master)
+
+	// a close before the close of the peer resets the stream
+	peer.Close()
+	st.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := st.Read(make([]byte, 1)); err != ErrStreamReset {
+		t.Fatalf("read after reset: %v", err)
+	}
+	if _, err := st.Write([]byte("x")); err != ErrStreamReset {
+		t.Fatalf("write after reset: %v", err)
+	}
+
+	// the session carries on
+	st, peer = openStream(t, slaver, master)
+	st.Write([]byte("x"))
+	st.CloseWrite()
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	if b, err := ioutil.ReadAll(peer); err != nil || string(b) != "x" {
+		t.Fatalf("read %q, %v", b, err)
+	}
+}
+
+func TestMuxPushClosed(t *testing.T) {
+	slaver, master := muxPair()
+	defer slaver.Close()
+	defer master.Close()
+	st, _ := openStream(t, slaver, master)
+	st.Close()
+
+	// data in flight still takes window, the peer sent it against it
+	if !st.push(make([]byte, 1000)) {
+		t.Fatal("push to a closed stream reset it")
+	}
+	st.lock.Lock()
+	recvWindow, buffered := st.recvWindow, st.buf.Len()
+	st.lock.Unlock()
+	if recvWindow != _MUX_WINDOW-1000 || buffered != 0 {
+		t.Fatalf("recv window %d, %d bytes buffered", recvWindow, buffered)
+	}
+
+	// and overrunning the window resets it
+	if st.push(make([]byte, _MUX_WINDOW)) {
+		t.Fatal("push over the window accepted")
+	}
+}
+
+func TestMuxTeardown(t *testing.T) {
+	slaver, master := muxPair()
+	defer slaver.Close()
+	st, _ := openStream(t, slaver, master)
+
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := slaver.Accept()
+		accepted <- err
+	}()
+	read := make(chan error, 1)
+	go func() {
+		_, err := st.Read(make([]byte, 1))
+		read <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	master.Close()
+	for name, ch := range map[string]chan error{
+		"accept": accepted,
+		"read":   read,
+	} {
+		select {
+		case err := <-ch:
+			if err == nil {
+				t.Fatalf("%s returned no error", name)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s still blocked after the teardown", name)
+		}
+	}
+
+	if _, err := slaver.Open(); err == nil {
+		t.Fatal("open on a closed session")
+	}
+}
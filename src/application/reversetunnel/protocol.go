@@ -12,6 +12,12 @@ const (
 	CMD_V1_BUILD_TUNNEL     = 0x02 // master ask for build tunnel
 	CMD_V1_BUILD_TUNNEL_ACK = 0x03 // slaver response of build tunnel request
 	CMD_V1_HEARTBEAT        = 0x04 // check server alive
+	CMD_V1_AUTH_CHALLENGE   = 0x05 // master ask slaver to authenticate
+	CMD_V1_AUTH             = 0x06 // slaver response of auth challenge
+	CMD_V1_JOIN_MUX         = 0x07 // slaver join master, multiplexed
+	CMD_V1_BUILD_UDP_TUNNEL = 0x08 // master ask for build udp tunnel
+	CMD_V1_SERVICES         = 0x09 // slaver ask for tunnels to its services
+	CMD_V1_SERVICES_ACK     = 0x0a // master response of services request
 	CMD_V1_UNKNOWN          = 0xff
 )
 
@@ -23,6 +29,32 @@ const (
 // |  1  | X'00' |    1     | 1 to 64 |
 // +-----+-------+----------+---------+
 
+// When the master requires authentication, it sends a challenge first:
+
+// +-----+-------+--------+-------+
+// | VER |  CMD  | METHOD | NONCE |
+// +-----+-------+--------+-------+
+// |  1  | X'05' |   1    |  32   |
+// +-----+-------+--------+-------+
+
+// o METHOD
+//   o X'01' HMAC-SHA256 keyed by the shared token
+//   o X'02' Ed25519 signature by the key of the slaver
+
+const (
+	AUTH_METHOD_TOKEN   = 0x01
+	AUTH_METHOD_ED25519 = 0x02
+)
+
+// The slaver answers with the MAC or the signature of NONCE followed by
+// NAME, an empty SIG when it has no credential for METHOD:
+
+// +-----+-------+---------+----------+
+// | VER |  CMD  | SIG.LEN |   SIG    |
+// +-----+-------+---------+----------+
+// |  1  | X'06' |    1    | 0 to 255 |
+// +-----+-------+---------+----------+
+
 // The master response:
 
 // +-----+-------+-----+
@@ -34,11 +66,17 @@ const (
 // o REP
 //   o X'00' succeeds
 //   o X'01' duplicate slaver name error
+//   o X'03' authentication failed
+//   o X'06' the slaver was kicked, and may not join again yet
 
 const (
 	REP_SUCCEEDS            = 0x00
 	REP_ERR_DUP_SLAVER_NAME = 0x01
 	REP_ERR_CONN_REFUSED    = 0x02
+	REP_ERR_AUTH_FAILED     = 0x03
+	REP_ERR_LISTEN          = 0x04
+	REP_ERR_SERVICE         = 0x05
+	REP_ERR_KICKED          = 0x06
 )
 
 // After connected, slaver sends heartbeat to master,
@@ -53,25 +91,113 @@ const (
 // The master send command to slaver to build tunnel,
 // The master listen the M.ADDR:M.PORT
 
-// +-----+-------+--------+--------+--------+--------+--------+--------+------+
-// | VER |  CMD  | M.ATYP | M.ADDR | M.PORT | S.ATYP | S.ADDR | S.PORT | C.ID |
-// +-----+-------+--------+--------+--------+--------+--------+--------+------+
-// |  1  | X'02' |    1   |   Var  |   2    |   1    |   Var  |   2    |  4   |
-// +-----+-------+--------+--------+--------+--------+--------+--------+------+
+// +-----+-------+--------+--------+--------+--------+--------+--------+------+-------+
+// | VER |  CMD  | M.ATYP | M.ADDR | M.PORT | S.ATYP | S.ADDR | S.PORT | C.ID | TOKEN |
+// +-----+-------+--------+--------+--------+--------+--------+--------+------+-------+
+// |  1  | X'02' |    1   |   Var  |   2    |   1    |   Var  |   2    |  4   |  16   |
+// +-----+-------+--------+--------+--------+--------+--------+--------+------+-------+
 
 // o ATYP address type of following address
 //   o X'01' IP V4 address
 //   o X'02' IP V6 address
+//   o X'03' domain name, the first octet is its length, the slaver
+//     resolves it in its own network
+// o TOKEN random bytes of the connection, only the slaver told about
+//   C.ID knows them
 
 const (
-	ATYP_IPV4 = 0x01
-	ATYP_IPV6 = 0x02
+	ATYP_IPV4   = 0x01
+	ATYP_IPV6   = 0x02
+	ATYP_DOMAIN = 0x03
 )
 
+// For a udp tunnel the command is X'08' with the same fields, the master
+// listens on udp and sends the command for every new client address. The
+// tunnel connection then carries the datagrams between the client and
+// S.ADDR:S.PORT, each one prefixed by its length:
+
+// +-----+----------+
+// | LEN |   DATA   |
+// +-----+----------+
+// |  2  | 0 to 64K |
+// +-----+----------+
+
 // The slaver send the reply to M.ADDR:M.PORT
 
-// +-----+-------+----------+---------+------+-----+
-// | VER |  CMD  | NAME.LEN |  NAME   | C.ID | REP |
-// +-----+-------+----------+---------+------+-----+
-// |  1  | X'03' |    1     | 1 to 64 |  4   |  1  |
-// +-----+-------+----------+---------+------+-----+
+// +-----+-------+----------+---------+------+-------+-----+
+// | VER |  CMD  | NAME.LEN |  NAME   | C.ID | TOKEN | REP |
+// +-----+-------+----------+---------+------+-------+-----+
+// |  1  | X'03' |    1     | 1 to 64 |  4   |  16   |  1  |
+// +-----+-------+----------+---------+------+-------+-----+
+
+// The master drops a reply whose TOKEN is not the one of C.ID.
+
+// Once joined, the slaver may ask for tunnels to its own services, the
+// master listens on M.PORT of its service host for each:
+
+// +-----+-------+-------+----------+
+// | VER |  CMD  | COUNT | SERVICES |
+// +-----+-------+-------+----------+
+// |  1  | X'09' |   1   |   Var    |
+// +-----+-------+-------+----------+
+
+// every service is:
+
+// +----------+---------+---------+--------+--------+--------+--------+
+// | NAME.LEN |  NAME   | NETWORK | M.PORT | S.ATYP | S.ADDR | S.PORT |
+// +----------+---------+---------+--------+--------+--------+--------+
+// |    1     | 1 to 64 |    1    |   2    |   1    |  Var   |   2    |
+// +----------+---------+---------+--------+--------+--------+--------+
+
+// o NETWORK
+//   o X'01' tcp
+//   o X'02' udp
+
+const (
+	SERVICE_NET_TCP = 0x01
+	SERVICE_NET_UDP = 0x02
+)
+
+// The master replies with a REP per service, in the same order:
+
+// +-----+-------+-------+----------+---------+-----+
+// | VER |  CMD  | COUNT | NAME.LEN |  NAME   | REP |
+// +-----+-------+-------+----------+---------+-----+
+// |  1  | X'0a' |   1   |    1     | 1 to 64 |  1  |
+// +-----+-------+-------+----------+---------+-----+
+
+// o REP
+//   o X'00' succeeds
+//   o X'04' the master cannot listen on M.PORT
+//   o X'05' services are not allowed or the service is invalid
+
+// A slaver joining with CMD_V1_JOIN_MUX instead of CMD_V1_JOIN, with the
+// same NAME, turns the ctrl connection into a multiplexed session after a
+// succeeded reply. Everything is then sent in frames:
+
+// +------+-----------+--------+-----------+
+// | TYPE | STREAM.ID | LENGTH |   DATA    |
+// +------+-----------+--------+-----------+
+// |  1   |     4     |   2    | 0 to 16K  |
+// +------+-----------+--------+-----------+
+
+// o TYPE
+//   o X'01' open a stream, ids are odd when opened by the slaver
+//   o X'02' data
+//   o X'03' window update, DATA is the 4 bytes increment
+//   o X'04' close, the sender sends no more data
+//   o X'05' reset, the stream is aborted
+
+// Stream 0 is open from the start and carries the ctrl commands. Instead of
+// dialing the tunnel address, the slaver opens a stream and sends the
+// CMD_V1_BUILD_TUNNEL_ACK in it. A sender may have at most the window of
+// the stream, 256K at the start, sent and not yet given back by a window
+// update.
+
+const (
+	MUX_FRAME_OPEN   = 0x01
+	MUX_FRAME_DATA   = 0x02
+	MUX_FRAME_WINDOW = 0x03
+	MUX_FRAME_CLOSE  = 0x04
+	MUX_FRAME_RESET  = 0x05
+)
@@ -2,17 +2,27 @@ package reversetunnel
 
 import (
 	"bytes"
+	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"net"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/solomonwzs/goxutil/logger"
 )
 
 type genCid func() connectionid
 
+// _TUNNEL_TOKEN_LEN random bytes bind the reply of a slaver to the build
+// tunnel command of a connection, cids are easy to guess.
+const _TUNNEL_TOKEN_LEN = 16
+
 type ptunnelConnReq struct {
-	cid connectionid
-	t   *proxyTunnel
+	cid   connectionid
+	token []byte
+	t     *proxyTunnel
 }
 
 type proxyTunnel struct {
@@ -20,22 +30,34 @@ type proxyTunnel struct {
 	listenAddr     string
 	mAddr          *address
 	sAddr          *address
+	udp            bool
 	tunnelCmdPre   []byte
 	gcid           genCid
 
+	req        *buildTunnelReq
+	createTime time.Time
+	connCount  int32
+
 	ch        chan *channelEvent
 	agentChan chan *channelEvent
 
 	ptConns map[connectionid]*proxyTunnelConn
 }
 
-func newProxyTunnel(mAddr, sAddr *address, listenAddr string,
-	agentChan chan *channelEvent, g genCid) (pt *proxyTunnel, err error) {
+func newProxyTunnel(mAddr, sAddr *address, req *buildTunnelReq,
+	clientListener net.Listener, agentChan chan *channelEvent,
+	g genCid) (pt *proxyTunnel) {
+	udp := req.Network == "udp"
 	pt = &proxyTunnel{
-		listenAddr: listenAddr,
-		mAddr:      mAddr,
-		sAddr:      sAddr,
-		gcid:       g,
+		clientListener: clientListener,
+		listenAddr:     req.MAddr,
+		mAddr:          mAddr,
+		sAddr:          sAddr,
+		udp:            udp,
+		gcid:           g,
+
+		req:        req,
+		createTime: time.Now(),
 
 		ch:        make(chan *channelEvent, _CHANNEL_SIZE),
 		agentChan: agentChan,
@@ -44,19 +66,34 @@ func newProxyTunnel(mAddr, sAddr *address, listenAddr string,
 	}
 
 	buf := new(bytes.Buffer)
-	buf.Write([]byte{PROTO_VER, CMD_V1_BUILD_TUNNEL})
-	buf.Write([]byte{pt.mAddr.atype})
-	buf.Write(pt.mAddr.ip)
-	buf.Write(pt.mAddr.port[:])
-	buf.Write([]byte{pt.sAddr.atype})
-	buf.Write(pt.sAddr.ip)
-	buf.Write(pt.sAddr.port[:])
+	cmd := byte(CMD_V1_BUILD_TUNNEL)
+	if udp {
+		cmd = CMD_V1_BUILD_UDP_TUNNEL
+	}
+	buf.Write([]byte{PROTO_VER, cmd})
+	buf.Write(pt.mAddr.bytes())
+	buf.Write(pt.sAddr.bytes())
 	pt.tunnelCmdPre = buf.Bytes()
 
-	pt.clientListener, err = net.Listen("tcp", listenAddr)
 	return
 }
 
+// tunnelKey identifies a tunnel in its slaver agent, a tcp and a udp
+// tunnel may share a port.
+func tunnelKey(req *buildTunnelReq) string {
+	switch req.Network {
+	case "udp":
+		return "udp://" + req.MAddr
+	case "http", "https":
+		return req.Network + "://" + strings.Join(req.Domains, ",")
+	}
+	return req.MAddr
+}
+
+func (pt *proxyTunnel) key() string {
+	return tunnelKey(pt.req)
+}
+
 func (pt *proxyTunnel) listenClientConn() {
 	for {
 		if conn, err := pt.clientListener.Accept(); err != nil {
@@ -75,17 +112,25 @@ func (pt *proxyTunnel) serve() {
 		switch e.typ {
 		case _EVENT_PT_NEW_PTUNNEL_CONN:
 			conn := e.data.(net.Conn)
-			c := newWaitingProxyTunnelConn(conn, pt.ch, pt.gcid())
+			token := make([]byte, _TUNNEL_TOKEN_LEN)
+			if _, err := rand.Read(token); err != nil {
+				logger.Error(err)
+				conn.Close()
+				break
+			}
+			c := newWaitingProxyTunnelConn(conn, pt.ch, pt.gcid(), pt.udp)
 			logger.Infof("master: new conn, cid: %d\n", c.cid)
 			go c.serve()
 			pt.ptConns[c.cid] = c
+			atomic.StoreInt32(&pt.connCount, int32(len(pt.ptConns)))
 			(&channelEvent{
 				_EVENT_SA_NEW_PTUNNEL_CONN,
-				&ptunnelConnReq{c.cid, pt}}).sendTo(pt.agentChan)
+				&ptunnelConnReq{c.cid, token, pt}}).sendTo(pt.agentChan)
 
 			buf := new(bytes.Buffer)
 			buf.Write(pt.tunnelCmdPre)
 			binary.Write(buf, binary.BigEndian, c.cid)
+			buf.Write(token)
 			(&channelEvent{_EVENT_SA_SEND_DATA, buf.Bytes()}).sendTo(
 				pt.agentChan)
 		case _EVENT_PT_PTUNNEL_CONN_ACK:
@@ -102,10 +147,16 @@ func (pt *proxyTunnel) serve() {
 			if _, exist := pt.ptConns[cid]; exist {
 				logger.Infof("master: end conn, cid: %d\n", cid)
 				delete(pt.ptConns, cid)
+				atomic.StoreInt32(&pt.connCount, int32(len(pt.ptConns)))
 			}
 		case _EVENT_PT_ACCEPT_ERROR:
-			logger.Error(e.data.(error))
+			// the listener is closed by the agent when the slaver leaves
+			if err := e.data.(error); !errors.Is(err, net.ErrClosed) {
+				logger.Error(err)
+			}
 			goto end
+		case _EVENT_PT_API:
+			pt.api(e.data.(*apiReq))
 		case _EVENT_PT_SHUTDOWN:
 			goto end
 		default:
@@ -115,6 +166,48 @@ end:
 	pt.terminate()
 }
 
+// info may be called by the slaver agent, ptConns is read in api only.
+func (pt *proxyTunnel) info() *tunnelInfo {
+	network := pt.req.Network
+	if network == "" {
+		network = "tcp"
+	}
+	return &tunnelInfo{
+		ID:         pt.req.ID,
+		Name:       pt.req.Name,
+		SlaverName: pt.req.SlaverName,
+		MAddr:      pt.listenAddr,
+		Domains:    pt.req.Domains,
+		SAddr:      pt.req.SAddr,
+		Network:    network,
+		CreateTime: pt.createTime,
+		ConnCount:  int(atomic.LoadInt32(&pt.connCount)),
+	}
+}
+
+func (pt *proxyTunnel) api(req *apiReq) {
+	switch req.kind {
+	case _API_GET_TUNNEL:
+		info := pt.info()
+		for _, c := range pt.ptConns {
+			info.Conns = append(info.Conns, &connInfo{
+				Cid:        c.cid,
+				ClientAddr: c.mConn.RemoteAddr().String(),
+				StartTime:  c.startTime,
+			})
+		}
+		req.replies <- info
+	case _API_CLOSE_CONN:
+		c, exist := pt.ptConns[req.cid]
+		if exist {
+			(&channelEvent{_EVENT_PTC_CLOSE, nil}).sendTo(c.ch)
+		}
+		req.replies <- exist
+	default:
+		req.replies <- nil
+	}
+}
+
 func (pt *proxyTunnel) terminate() {
 	(&channelEvent{_EVENT_PT_TERMINATE, pt}).sendTo(pt.agentChan)
 	pt.clientListener.Close()
@@ -3,8 +3,8 @@ package reversetunnel
 import (
 	"bytes"
 	"encoding/binary"
-	"io"
 	"net"
+	"relay"
 	"time"
 )
 
@@ -19,18 +19,22 @@ type proxyTunnelConn struct {
 	mConn net.Conn
 	sConn net.Conn
 
-	cid    connectionid
-	status int
+	cid       connectionid
+	status    int
+	udp       bool
+	startTime time.Time
 
 	superiorChan chan *channelEvent
 	ch           chan *channelEvent
 }
 
 func newWaitingProxyTunnelConn(conn net.Conn, ptChan chan *channelEvent,
-	cid connectionid) (c *proxyTunnelConn) {
+	cid connectionid, udp bool) (c *proxyTunnelConn) {
 	return &proxyTunnelConn{
 		mConn:        conn,
 		cid:          cid,
+		udp:          udp,
+		startTime:    time.Now(),
 		superiorChan: ptChan,
 		ch:           make(chan *channelEvent, _CHANNEL_SIZE),
 		status:       _PTC_STATUS_WAITING,
@@ -38,10 +42,12 @@ func newWaitingProxyTunnelConn(conn net.Conn, ptChan chan *channelEvent,
 }
 
 func asyncNewReadyProxyTunnelConn(info *proxyTunnelConnInfo,
-	slaverName string, ch chan *channelEvent) {
+	slaverName string, dial func(string) (net.Conn, error),
+	ch chan *channelEvent) {
 	var err error = nil
 	c := &proxyTunnelConn{
 		cid:          info.cid,
+		udp:          info.udp,
 		ch:           make(chan *channelEvent, _CHANNEL_SIZE),
 		superiorChan: ch,
 		status:       _PTC_STATUS_READY,
@@ -55,7 +61,7 @@ func asyncNewReadyProxyTunnelConn(info *proxyTunnelConnInfo,
 		}
 	}()
 
-	if c.mConn, err = net.Dial("tcp", info.mAddr.String()); err != nil {
+	if c.mConn, err = dial(info.mAddr.String()); err != nil {
 		return
 	}
 
@@ -64,8 +70,13 @@ func asyncNewReadyProxyTunnelConn(info *proxyTunnelConnInfo,
 	binary.Write(buf, binary.BigEndian, byte(len(slaverName)))
 	buf.Write([]byte(slaverName))
 	binary.Write(buf, binary.BigEndian, c.cid)
+	buf.Write(info.token)
 
-	if c.sConn, err = net.Dial("tcp", info.sAddr.String()); err != nil {
+	network := "tcp"
+	if c.udp {
+		network = "udp"
+	}
+	if c.sConn, err = net.Dial(network, info.sAddr.String()); err != nil {
 		buf.WriteByte(REP_ERR_CONN_REFUSED)
 	} else {
 		buf.WriteByte(REP_SUCCEEDS)
@@ -89,9 +100,14 @@ func (c *proxyTunnelConn) Close() error {
 	return nil
 }
 
-func (c *proxyTunnelConn) dataTransport() {
-	go io.Copy(c.mConn, c.sConn)
-	io.Copy(c.sConn, c.mConn)
+// dataTransport relays between the local end and the tunnel connection,
+// the client on the master side, the target on the slaver side.
+func (c *proxyTunnelConn) dataTransport(local, tunnel net.Conn) {
+	if c.udp {
+		udpRelay(local, tunnel, _UDP_SESSION_IDLE)
+	} else {
+		relay.Relay(local, tunnel, nil)
+	}
 	(&channelEvent{_EVENT_PTC_TRANS_END, nil}).sendTo(c.ch)
 }
 
@@ -106,12 +122,12 @@ func (c *proxyTunnelConn) serve() {
 
 				c.sConn = e.data.(net.Conn)
 				c.status = _PTC_STATUS_TRANSPORT
-				go c.dataTransport()
+				go c.dataTransport(c.mConn, c.sConn)
 			}
 		case _EVENT_PTC_TRANS_START:
 			if c.status == _PTC_STATUS_READY {
 				c.status = _PTC_STATUS_TRANSPORT
-				go c.dataTransport()
+				go c.dataTransport(c.sConn, c.mConn)
 			}
 		case _EVENT_PTC_TRANS_END:
 			if c.status == _PTC_STATUS_TRANSPORT {
@@ -0,0 +1,91 @@
+package reversetunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strconv"
+)
+
+// serviceConfig is a service of the slaver, exposed on RemotePort of the
+// master.
+type serviceConfig struct {
+	Name       string `json:"name"`
+	Local      string `json:"local"`
+	RemotePort uint16 `json:"remote_port"`
+
+	// "tcp" or "udp", default "tcp"
+	Network string `json:"network,omitempty"`
+}
+
+type service struct {
+	name  string
+	udp   bool
+	mPort uint16
+	sAddr *address
+}
+
+type serviceAck struct {
+	name string
+	rep  byte
+}
+
+// servicesCommand encodes the CMD_V1_SERVICES of the slaver, nil when it
+// has no service.
+func servicesCommand(confs []*serviceConfig) ([]byte, error) {
+	if len(confs) == 0 {
+		return nil, nil
+	} else if len(confs) > 0xff {
+		return nil, ErrService
+	}
+
+	buf := new(bytes.Buffer)
+	buf.Write([]byte{PROTO_VER, CMD_V1_SERVICES, byte(len(confs))})
+	for _, c := range confs {
+		network := byte(SERVICE_NET_TCP)
+		if c.Network == "udp" {
+			network = SERVICE_NET_UDP
+		} else if c.Network != "" && c.Network != "tcp" {
+			return nil, ErrNetwork
+		}
+		addr := parseAddr(c.Local)
+		if len(c.Name) == 0 || len(c.Name) > 64 || addr == nil {
+			return nil, ErrService
+		}
+
+		buf.Write([]byte{byte(len(c.Name))})
+		buf.WriteString(c.Name)
+		buf.Write([]byte{network})
+		binary.Write(buf, binary.BigEndian, c.RemotePort)
+		buf.Write(addr.bytes())
+	}
+	return buf.Bytes(), nil
+}
+
+// tunnelReq returns the tunnel of a service listening on host.
+func (s *service) tunnelReq(host, slaverName string) *buildTunnelReq {
+	req := &buildTunnelReq{
+		MAddr:      net.JoinHostPort(host, strconv.Itoa(int(s.mPort))),
+		SAddr:      s.sAddr.String(),
+		SlaverName: slaverName,
+		Network:    "tcp",
+		Name:       s.name,
+	}
+	if s.udp {
+		req.Network = "udp"
+	}
+	return req
+}
+
+func serviceAckError(rep byte) error {
+	switch rep {
+	case REP_SUCCEEDS:
+		return nil
+	case REP_ERR_LISTEN:
+		return ErrListen
+	case REP_ERR_SERVICE:
+		return ErrService
+	default:
+		return ErrReply
+	}
+}
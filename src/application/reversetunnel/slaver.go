@@ -2,6 +2,7 @@ package reversetunnel
 
 import (
 	"bytes"
+	"crypto/tls"
 	"net"
 	"time"
 
@@ -16,8 +17,14 @@ type slaverServer struct {
 	ctrl       net.Conn
 	masterAddr string
 	name       string
+	cred       *slaverCred
+	tlsConf    *tls.Config
+	mux        bool
+	session    *muxSession
+	services   []byte
 	ch         chan *channelEvent
 	bytesCh    chan []byte
+	done       chan struct{}
 	conns      map[connectionid]*proxyTunnelConn
 }
 
@@ -25,13 +32,49 @@ func newSlaverServer(conf *config) *slaverServer {
 	s := &slaverServer{
 		masterAddr: conf.JoinAddr,
 		name:       conf.Name,
+		mux:        conf.Mux,
 		ch:         make(chan *channelEvent, _CHANNEL_SIZE),
 		bytesCh:    make(chan []byte, _CHANNEL_SIZE),
+		done:       make(chan struct{}),
 		conns:      map[connectionid]*proxyTunnelConn{},
 	}
+
+	var err error
+	if s.cred, err = newSlaverCred(conf); err != nil {
+		panic(err)
+	}
+	if conf.TLS != nil {
+		if s.tlsConf, err = conf.TLS.clientConfig(conf.JoinAddr); err != nil {
+			panic(err)
+		}
+	}
+	if s.services, err = servicesCommand(conf.Services); err != nil {
+		panic(err)
+	}
 	return s
 }
 
+// dial connects to the ctrl or the tunnel address of the master, once
+// joined in mux mode a tunnel connection is a new stream instead.
+func (s *slaverServer) dial(addr string) (net.Conn, error) {
+	if s.session != nil {
+		st, err := s.session.Open()
+		if err != nil {
+			return nil, err
+		}
+		return st, nil
+	}
+	if s.tlsConf == nil {
+		return net.Dial("tcp", addr)
+	}
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: _NETWORK_TIMEOUT},
+		"tcp", addr, s.tlsConf)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
 func (s *slaverServer) heartbeat() {
 	for {
 		(&channelEvent{_EVENT_S_SEND_DATA, _BYTES_V1_HEARTBEAT}).sendTo(s.ch)
@@ -41,7 +84,11 @@ func (s *slaverServer) heartbeat() {
 
 func (s *slaverServer) joinMaster() (err error) {
 	buf := new(bytes.Buffer)
-	buf.Write([]byte{PROTO_VER, CMD_V1_JOIN, byte(len(s.name))})
+	cmd := byte(CMD_V1_JOIN)
+	if s.mux {
+		cmd = CMD_V1_JOIN_MUX
+	}
+	buf.Write([]byte{PROTO_VER, cmd, byte(len(s.name))})
 	buf.WriteString(s.name)
 	retry := false
 	for {
@@ -57,7 +104,7 @@ func (s *slaverServer) joinMaster() (err error) {
 		}
 
 		retry = true
-		s.ctrl, err = net.Dial("tcp", s.masterAddr)
+		s.ctrl, err = s.dial(s.masterAddr)
 		if err != nil {
 			continue
 		} else {
@@ -72,6 +119,14 @@ func (s *slaverServer) joinMaster() (err error) {
 			if err != nil {
 				continue
 			}
+			if b == CMD_V1_AUTH_CHALLENGE {
+				if err = s.answerChallenge(); err != nil {
+					continue
+				}
+				if b, err = parseCommandV1(s.ctrl); err != nil {
+					continue
+				}
+			}
 			if b != CMD_V1_JOIN_ACK {
 				err = ErrCommand
 				continue
@@ -84,12 +139,22 @@ func (s *slaverServer) joinMaster() (err error) {
 			if b != REP_SUCCEEDS {
 				if b == REP_ERR_DUP_SLAVER_NAME {
 					err = ErrDupicateSlaverName
+				} else if b == REP_ERR_AUTH_FAILED {
+					err = ErrAuthFailed
+				} else if b == REP_ERR_KICKED {
+					err = ErrSlaverKicked
 				} else {
 					err = ErrCommand
 				}
 				continue
 			}
 
+			if s.mux {
+				s.ctrl.SetDeadline(time.Time{})
+				s.session = newMuxSession(s.ctrl, true)
+				s.ctrl = s.session.ctrl
+			}
+
 			logger.Info("slaver: join master")
 			break
 		}
@@ -98,6 +163,20 @@ func (s *slaverServer) joinMaster() (err error) {
 	return
 }
 
+func (s *slaverServer) answerChallenge() (err error) {
+	method, nonce, err := parseAuthChallengeV1(s.ctrl)
+	if err != nil {
+		return
+	}
+
+	sig := s.cred.sign(method, nonce, s.name)
+	buf := new(bytes.Buffer)
+	buf.Write([]byte{PROTO_VER, CMD_V1_AUTH, byte(len(sig))})
+	buf.Write(sig)
+	_, err = s.ctrl.Write(buf.Bytes())
+	return
+}
+
 func (s *slaverServer) recvCommand() {
 	var (
 		cmd byte
@@ -116,16 +195,24 @@ func (s *slaverServer) recvCommand() {
 		}
 
 		switch cmd {
-		case CMD_V1_BUILD_TUNNEL:
-			info := new(proxyTunnelConnInfo)
+		case CMD_V1_BUILD_TUNNEL, CMD_V1_BUILD_UDP_TUNNEL:
+			info := &proxyTunnelConnInfo{udp: cmd == CMD_V1_BUILD_UDP_TUNNEL}
 			s.ctrl.SetReadDeadline(time.Now().Add(_NETWORK_TIMEOUT))
-			info.mAddr, info.sAddr, info.cid, err = parseBuildTunnelV1(
-				s.ctrl)
+			info.mAddr, info.sAddr, info.cid, info.token,
+				err = parseBuildTunnelV1(s.ctrl)
 			if err != nil {
 				(&channelEvent{_EVENT_S_CMD_ERROR, err}).sendTo(s.ch)
 				break
 			}
 			(&channelEvent{_EVENT_S_PT_CONN_INFO, info}).sendTo(s.ch)
+		case CMD_V1_SERVICES_ACK:
+			s.ctrl.SetReadDeadline(time.Now().Add(_NETWORK_TIMEOUT))
+			acks, err := parseServicesAckV1(s.ctrl)
+			if err != nil {
+				(&channelEvent{_EVENT_S_CONN_ERROR, err}).sendTo(s.ch)
+				return
+			}
+			(&channelEvent{_EVENT_S_SERVICES_ACK, acks}).sendTo(s.ch)
 		}
 	}
 }
@@ -136,9 +223,12 @@ func (s *slaverServer) serve() {
 		panic(err)
 	}
 
-	go sendData(s.ctrl, s.bytesCh, s.ch)
+	go sendData(s.ctrl, s.bytesCh, s.done, s.ch)
 	go s.heartbeat()
 	go s.recvCommand()
+	if s.services != nil {
+		(&channelEvent{_EVENT_S_SEND_DATA, s.services}).sendTo(s.ch)
+	}
 
 	for e := range s.ch {
 		switch e.typ {
@@ -147,7 +237,16 @@ func (s *slaverServer) serve() {
 			goto end
 		case _EVENT_S_PT_CONN_INFO:
 			info := e.data.(*proxyTunnelConnInfo)
-			go asyncNewReadyProxyTunnelConn(info, s.name, s.ch)
+			go asyncNewReadyProxyTunnelConn(info, s.name, s.dial, s.ch)
+		case _EVENT_S_SERVICES_ACK:
+			for _, ack := range e.data.([]*serviceAck) {
+				if err := serviceAckError(ack.rep); err != nil {
+					logger.Errorf("slaver: service [%s] error: %s\n",
+						ack.name, err)
+				} else {
+					logger.Infof("slaver: service [%s] exposed\n", ack.name)
+				}
+			}
 		case _EVENT_PTC_READY:
 			c := e.data.(*proxyTunnelConn)
 			logger.Infof("slaver: new conn, cid: %d\n", c.cid)
@@ -165,7 +264,7 @@ func (s *slaverServer) serve() {
 			}
 		case _EVENT_S_SEND_DATA:
 			data := e.data.([]byte)
-			go func() { s.bytesCh <- data }()
+			go queueData(s.bytesCh, s.done, data)
 		case _EVENT_X_SEND_DATA_ERR:
 			logger.Error(e.data.(error))
 			goto end
@@ -181,7 +280,7 @@ end:
 }
 
 func (s *slaverServer) terminate() {
-	close(s.bytesCh)
+	close(s.done)
 	s.ctrl.Close()
 
 	e := (&channelEvent{_EVENT_PTC_CLOSE, nil})
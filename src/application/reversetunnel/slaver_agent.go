@@ -1,7 +1,10 @@
 package reversetunnel
 
 import (
+	"bytes"
+	"crypto/hmac"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
@@ -11,34 +14,43 @@ import (
 type slaverAgent struct {
 	name string
 
-	tunnelAddr *address
-	ctrl       net.Conn
+	tunnelAddr  *address
+	serviceHost string
+	vhosts      map[string]*vhostRouter
+	ctrl        net.Conn
+	joinTime    time.Time
 
 	pTunnels       map[string]*proxyTunnel
-	waitingTunnels map[connectionid]*proxyTunnel
+	waitingTunnels map[connectionid]*ptunnelConnReq
 
 	ch         chan *channelEvent
 	masterChan chan *channelEvent
 	bytesCh    chan []byte
+	done       chan struct{}
 
 	currentCid connectionid
 	cidLock    *sync.Mutex
 }
 
 func newSlaverAgent(name string, conn net.Conn, tunnelAddr *address,
+	serviceHost string, vhosts map[string]*vhostRouter,
 	ch chan *channelEvent) *slaverAgent {
 
 	return &slaverAgent{
 		name: name,
 
-		tunnelAddr: tunnelAddr,
-		ctrl:       conn,
+		tunnelAddr:  tunnelAddr,
+		serviceHost: serviceHost,
+		vhosts:      vhosts,
+		ctrl:        conn,
+		joinTime:    time.Now(),
 
 		pTunnels:       map[string]*proxyTunnel{},
-		waitingTunnels: map[connectionid]*proxyTunnel{},
+		waitingTunnels: map[connectionid]*ptunnelConnReq{},
 
 		ch:         make(chan *channelEvent, _CHANNEL_SIZE),
 		bytesCh:    make(chan []byte, _CHANNEL_SIZE),
+		done:       make(chan struct{}),
 		masterChan: ch,
 
 		currentCid: 1,
@@ -64,6 +76,13 @@ func (sa *slaverAgent) recvHeartbeat() {
 			break
 		} else if cmd == CMD_V1_HEARTBEAT {
 			continue
+		} else if cmd == CMD_V1_SERVICES {
+			services, err := parseServicesV1(sa.ctrl)
+			if err != nil {
+				(&channelEvent{_EVENT_SA_ERROR, err}).sendTo(sa.ch)
+				break
+			}
+			(&channelEvent{_EVENT_SA_SERVICES, services}).sendTo(sa.ch)
 		} else {
 			(&channelEvent{_EVENT_SA_ERROR, ErrCommand}).sendTo(sa.ch)
 			break
@@ -73,7 +92,7 @@ func (sa *slaverAgent) recvHeartbeat() {
 
 func (sa *slaverAgent) serve() {
 	go sa.recvHeartbeat()
-	go sendData(sa.ctrl, sa.bytesCh, sa.ch)
+	go sendData(sa.ctrl, sa.bytesCh, sa.done, sa.ch)
 
 	for e := range sa.ch {
 		switch e.typ {
@@ -83,26 +102,51 @@ func (sa *slaverAgent) serve() {
 			goto end
 		case _EVENT_SA_BUILD_TUNNEL_REQ:
 			req := e.data.(*buildTunnelReq)
-			sa.newProxyTunnel(req)
+			if !req.take() {
+				logger.Infof("master: slaver [%s] tunnel [%s] abandoned\n",
+					sa.name, tunnelKey(req))
+				break
+			}
+			pTunnel, err := sa.newProxyTunnel(req)
+			if err != nil {
+				logger.Errorf("master: slaver [%s] tunnel [%s] error: %s\n",
+					sa.name, tunnelKey(req), err)
+				req.reply(nil, err)
+			} else {
+				req.reply(pTunnel.info(), nil)
+			}
+		case _EVENT_SA_API:
+			sa.api(e.data.(*apiReq))
+		case _EVENT_SA_SERVICES:
+			data := sa.exposeServices(e.data.([]*service))
+			go queueData(sa.bytesCh, sa.done, data)
 		case _EVENT_SA_SEND_DATA:
 			data := e.data.([]byte)
-			go func() { sa.bytesCh <- data }()
+			go queueData(sa.bytesCh, sa.done, data)
 		case _EVENT_X_SEND_DATA_ERR:
 			err := e.data.(error)
 			logger.Error(err)
 			goto end
 		case _EVENT_SA_NEW_PTUNNEL_CONN:
 			req := e.data.(*ptunnelConnReq)
-			sa.waitingTunnels[req.cid] = req.t
+			sa.waitingTunnels[req.cid] = req
 		case _EVENT_SA_PTUNNEL_CONN_ACK:
 			req := e.data.(*tunnelConnAckReq)
-			if t, exist := sa.waitingTunnels[req.cid]; exist {
+			if w, exist := sa.waitingTunnels[req.cid]; exist &&
+				hmac.Equal(w.token, req.token) {
 				delete(sa.waitingTunnels, req.cid)
-				(&channelEvent{_EVENT_PT_PTUNNEL_CONN_ACK, req}).sendTo(t.ch)
+				(&channelEvent{_EVENT_PT_PTUNNEL_CONN_ACK, req}).sendTo(
+					w.t.ch)
+			} else {
+				logger.Errorf("master: slaver [%s] cid %d: %s\n", sa.name,
+					req.cid, ErrAuthFailed)
+				if req.Conn != nil {
+					req.Close()
+				}
 			}
 		case _EVENT_PT_TERMINATE:
 			pt := e.data.(*proxyTunnel)
-			delete(sa.pTunnels, pt.listenAddr)
+			delete(sa.pTunnels, pt.key())
 			for cid, _ := range pt.ptConns {
 				delete(sa.waitingTunnels, cid)
 			}
@@ -114,28 +158,136 @@ end:
 	sa.terminate()
 }
 
-func (sa *slaverAgent) newProxyTunnel(req *buildTunnelReq) {
+func (sa *slaverAgent) newProxyTunnel(req *buildTunnelReq) (
+	pTunnel *proxyTunnel, err error) {
 	sAddr := parseAddr(req.SAddr)
 	if sAddr == nil {
-		return
+		return nil, ErrAddress
+	}
+	if _, exist := sa.pTunnels[tunnelKey(req)]; exist {
+		return nil, ErrTunnelExist
 	}
-	pTunnel, err := newProxyTunnel(sa.tunnelAddr, sAddr, req.MAddr,
-		sa.ch, sa.newCid)
+	l, err := sa.listen(req)
 	if err != nil {
-		return
+		return nil, err
 	}
+
+	// tunnels of the config are built again on every join
+	r := *req
+	if r.ID == 0 {
+		r.ID = newTunnelID()
+	}
+	pTunnel = newProxyTunnel(sa.tunnelAddr, sAddr, &r, l, sa.ch, sa.newCid)
 	go pTunnel.serve()
-	sa.pTunnels[req.MAddr] = pTunnel
+	sa.pTunnels[pTunnel.key()] = pTunnel
 
-	logger.Infof("master: new tunnel: [master:%s] <-> [%s:%s]\n",
-		req.MAddr, req.SlaverName, req.SAddr)
+	kind, mAddr := "tunnel", req.MAddr
+	if req.Network == "udp" {
+		kind = "udp tunnel"
+	} else if req.Network == "http" || req.Network == "https" {
+		kind = req.Network + " tunnel"
+		mAddr = strings.Join(req.Domains, ",")
+	}
+	logger.Infof("master: new %s: [master:%s] <-> [%s:%s]\n",
+		kind, mAddr, req.SlaverName, req.SAddr)
+	return
+}
+
+// listen returns the listener of a new tunnel, a port of its own for tcp
+// and udp, the domains on the shared port for http and https.
+func (sa *slaverAgent) listen(req *buildTunnelReq) (net.Listener, error) {
+	switch req.Network {
+	case "", "tcp", "udp":
+		if _, _, err := net.SplitHostPort(req.MAddr); err != nil {
+			return nil, ErrAddress
+		}
+		if req.Network == "udp" {
+			return listenUDP(req.MAddr)
+		}
+		return net.Listen("tcp", req.MAddr)
+	case "http", "https":
+		r := sa.vhosts[req.Network]
+		if r == nil {
+			return nil, ErrVhost
+		}
+		return r.listen(req.Domains)
+	}
+	return nil, ErrNetwork
+}
+
+// exposeServices builds the tunnels of the services the slaver advertised
+// and returns the reply.
+func (sa *slaverAgent) exposeServices(services []*service) []byte {
+	buf := new(bytes.Buffer)
+	buf.Write([]byte{PROTO_VER, CMD_V1_SERVICES_ACK, byte(len(services))})
+	for _, s := range services {
+		rep := byte(REP_SUCCEEDS)
+		if sa.serviceHost == "" {
+			rep = REP_ERR_SERVICE
+		} else if _, err := sa.newProxyTunnel(
+			s.tunnelReq(sa.serviceHost, sa.name)); err != nil {
+			logger.Errorf("master: slaver [%s] service [%s] error: %s\n",
+				sa.name, s.name, err)
+			rep = REP_ERR_LISTEN
+			if err == ErrAddress || err == ErrNetwork {
+				rep = REP_ERR_SERVICE
+			}
+		}
+		buf.Write([]byte{byte(len(s.name))})
+		buf.WriteString(s.name)
+		buf.Write([]byte{rep})
+	}
+	return buf.Bytes()
+}
+
+// api answers a query of the http api, or passes it on to the tunnel it
+// is about.
+func (sa *slaverAgent) api(req *apiReq) {
+	switch req.kind {
+	case _API_LIST_SLAVERS:
+		req.replies <- &slaverInfo{
+			Name:       sa.name,
+			RemoteAddr: sa.ctrl.RemoteAddr().String(),
+			JoinTime:   sa.joinTime,
+			Tunnels:    len(sa.pTunnels),
+		}
+	case _API_LIST_TUNNELS:
+		infos := []*tunnelInfo{}
+		for _, pt := range sa.pTunnels {
+			infos = append(infos, pt.info())
+		}
+		req.replies <- infos
+	case _API_GET_TUNNEL, _API_DELETE_TUNNEL, _API_CLOSE_CONN:
+		var pTunnel *proxyTunnel
+		for _, pt := range sa.pTunnels {
+			if pt.req.ID == req.tunnel {
+				pTunnel = pt
+				break
+			}
+		}
+		if pTunnel == nil {
+			req.replies <- nil
+		} else if req.kind == _API_DELETE_TUNNEL {
+			(&channelEvent{_EVENT_PT_SHUTDOWN, nil}).sendTo(pTunnel.ch)
+			req.replies <- true
+		} else {
+			(&channelEvent{_EVENT_PT_API, req}).sendTo(pTunnel.ch)
+		}
+	default:
+		req.replies <- nil
+	}
 }
 
 func (sa *slaverAgent) terminate() {
+	// free the ports before the slaver may join again and rebuild its
+	// configured tunnels
+	for _, pTunnel := range sa.pTunnels {
+		pTunnel.clientListener.Close()
+	}
 	(&channelEvent{_EVENT_SA_TERMINATE, sa.name}).sendTo(sa.masterChan)
 	sa.ctrl.Close()
 
-	close(sa.bytesCh)
+	close(sa.done)
 
 	shutdownEvent := &channelEvent{_EVENT_PT_SHUTDOWN, nil}
 	for _, pTunnel := range sa.pTunnels {
@@ -0,0 +1,120 @@
+package reversetunnel
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"relay"
+)
+
+// tlsConfig wraps the ctrl and tunnel channels in tls, files are pem
+// encoded. The master needs Cert and Key, with CA and ClientAuth it asks
+// the slavers for certificates whose common name is the slaver name. The
+// slaver verifies the master by CA, the system pool when empty, or by Pin.
+type tlsConfig struct {
+	Cert       string `json:"cert,omitempty"`
+	Key        string `json:"key,omitempty"`
+	CA         string `json:"ca,omitempty"`
+	ClientAuth bool   `json:"client_auth,omitempty"`
+
+	// slaver only, name verified in the master certificate, the host of
+	// the join address when empty
+	ServerName string `json:"server_name,omitempty"`
+
+	// slaver only, base64 sha256 of the accepted master public keys,
+	// which replace the name check
+	Pin []string `json:"pin,omitempty"`
+}
+
+// certPin returns the pin of a certificate, the base64 sha256 of its
+// subject public key info.
+func certPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// certFilePin returns the pin of the first certificate of a pem file.
+func certFilePin(file string) (pin string, err error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return "", ErrTLSConfig
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return
+	}
+	return certPin(cert), nil
+}
+
+func (c *tlsConfig) serverConfig() (*tls.Config, error) {
+	if c.Cert == "" || c.Key == "" || (c.ClientAuth && c.CA == "") {
+		return nil, ErrTLSConfig
+	}
+	return relay.ServerTLSConfig(c.Cert, c.Key, c.CA, c.ClientAuth)
+}
+
+func (c *tlsConfig) clientConfig(masterAddr string) (
+	conf *tls.Config, err error) {
+	if conf, err = relay.ClientTLSConfig(c.Cert, c.Key, c.CA); err != nil {
+		return
+	}
+	// tunnels are dialed to an address sent by the master, they check
+	// the same name as the ctrl connection
+	if conf.ServerName = c.ServerName; conf.ServerName == "" {
+		if conf.ServerName, _, err = net.SplitHostPort(masterAddr); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(c.Pin) > 0 {
+		pins := map[string]bool{}
+		for _, p := range c.Pin {
+			pins[p] = true
+		}
+		roots := conf.RootCAs
+		conf.InsecureSkipVerify = true
+		conf.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return ErrTLSPin
+			}
+			leaf := cs.PeerCertificates[0]
+			if roots != nil {
+				opts := x509.VerifyOptions{
+					Roots:         roots,
+					Intermediates: x509.NewCertPool(),
+				}
+				for _, cert := range cs.PeerCertificates[1:] {
+					opts.Intermediates.AddCert(cert)
+				}
+				if _, err := leaf.Verify(opts); err != nil {
+					return err
+				}
+			}
+			if !pins[certPin(leaf)] {
+				return ErrTLSPin
+			}
+			return nil
+		}
+	}
+	return
+}
+
+// peerName returns the common name of a verified client certificate.
+func peerName(conn net.Conn) (name string, ok bool) {
+	c, isTLS := conn.(*tls.Conn)
+	if !isTLS {
+		return
+	}
+	if chains := c.ConnectionState().VerifiedChains; len(chains) > 0 {
+		return chains[0][0].Subject.CommonName, true
+	}
+	return
+}
@@ -0,0 +1,180 @@
+package reversetunnel
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+// newTestCert writes a certificate of name signed by parent, a self signed
+// ca when parent is nil.
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{name},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth,
+			x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer,
+		&key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalPKCS8PrivateKey(key)
+
+	dir := t.TempDir()
+	c := &testCert{
+		cert:     cert,
+		key:      key,
+		certFile: filepath.Join(dir, "cert.pem"),
+		keyFile:  filepath.Join(dir, "key.pem"),
+	}
+	ioutil.WriteFile(c.certFile, pem.EncodeToMemory(
+		&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(c.keyFile, pem.EncodeToMemory(
+		&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600)
+	return c
+}
+
+// handshake runs a tls handshake between a master with server and a
+// slaver with conf, it returns the error of the slaver.
+func handshake(t *testing.T, server *testCert, conf *tlsConfig,
+	masterAddr string) error {
+	serverConf, err := (&tlsConfig{Cert: server.certFile,
+		Key: server.keyFile}).serverConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConf, err := conf.clientConfig(masterAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a pipe would block the alert of a failed verification
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		if s, err := ln.Accept(); err == nil {
+			tls.Server(s, serverConf).Handshake()
+			s.Close()
+		}
+	}()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	return tls.Client(c, clientConf).Handshake()
+}
+
+func TestTLSClientCA(t *testing.T) {
+	ca := newTestCert(t, "ca", nil)
+	otherCA := newTestCert(t, "other ca", nil)
+	server := newTestCert(t, "master.test", ca)
+
+	cases := []struct {
+		name       string
+		conf       *tlsConfig
+		masterAddr string
+		ok         bool
+	}{
+		{"name of the join address", &tlsConfig{CA: ca.certFile},
+			"master.test:18073", true},
+		{"server name", &tlsConfig{CA: ca.certFile,
+			ServerName: "master.test"}, "127.0.0.1:18073", true},
+		{"wrong name", &tlsConfig{CA: ca.certFile},
+			"127.0.0.1:18073", false},
+		{"other ca", &tlsConfig{CA: otherCA.certFile},
+			"master.test:18073", false},
+	}
+	for _, c := range cases {
+		if err := handshake(t, server, c.conf, c.masterAddr); (err == nil) !=
+			c.ok {
+			t.Errorf("%s: %v", c.name, err)
+		}
+	}
+}
+
+func TestTLSClientPin(t *testing.T) {
+	ca := newTestCert(t, "ca", nil)
+	server := newTestCert(t, "master.test", ca)
+	selfSigned := newTestCert(t, "master.test", nil)
+	pin, err := certFilePin(server.certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	selfPin := certPin(selfSigned.cert)
+
+	cases := []struct {
+		name   string
+		server *testCert
+		conf   *tlsConfig
+		ok     bool
+	}{
+		// the pin replaces the name check
+		{"pin", server, &tlsConfig{Pin: []string{pin}}, true},
+		{"self signed pin", selfSigned,
+			&tlsConfig{Pin: []string{"x", selfPin}}, true},
+		{"wrong pin", server, &tlsConfig{Pin: []string{selfPin}}, false},
+		{"pin and ca", server,
+			&tlsConfig{CA: ca.certFile, Pin: []string{pin}}, true},
+		{"pin not signed by the ca", selfSigned,
+			&tlsConfig{CA: ca.certFile, Pin: []string{selfPin}}, false},
+	}
+	for _, c := range cases {
+		if err := handshake(t, c.server, c.conf,
+			"127.0.0.1:18073"); (err == nil) != c.ok {
+			t.Errorf("%s: %v", c.name, err)
+		}
+	}
+}
+
+func TestTLSServerConfig(t *testing.T) {
+	server := newTestCert(t, "master.test", nil)
+	for _, c := range []*tlsConfig{
+		{Key: server.keyFile},
+		{Cert: server.certFile},
+		{Cert: server.certFile, Key: server.keyFile, ClientAuth: true},
+	} {
+		if _, err := c.serverConfig(); err != ErrTLSConfig {
+			t.Errorf("%+v: %v", c, err)
+		}
+	}
+}
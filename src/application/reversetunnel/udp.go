@@ -0,0 +1,222 @@
+package reversetunnel
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	_UDP_MAX_DATAGRAM = 65535
+
+	// a udp session ends after this long without a datagram either way
+	_UDP_SESSION_IDLE = 60 * time.Second
+)
+
+// udpListener is the listener of a udp tunnel, every new client address
+// is accepted as a conn whose reads and writes are single datagrams.
+type udpListener struct {
+	pc       net.PacketConn
+	conns    map[string]*udpClientConn
+	acceptCh chan *udpClientConn
+	err      error
+	lock     *sync.Mutex
+}
+
+func listenUDP(addr string) (l *udpListener, err error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return
+	}
+	l = &udpListener{
+		pc:       pc,
+		conns:    map[string]*udpClientConn{},
+		acceptCh: make(chan *udpClientConn, _CHANNEL_SIZE),
+		lock:     &sync.Mutex{},
+	}
+	go l.recvPackets()
+	return
+}
+
+func (l *udpListener) recvPackets() {
+	buf := make([]byte, _UDP_MAX_DATAGRAM)
+	for {
+		n, addr, err := l.pc.ReadFrom(buf)
+		if err != nil {
+			l.lock.Lock()
+			l.err = err
+			close(l.acceptCh)
+			l.lock.Unlock()
+			return
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+
+		key := addr.String()
+		l.lock.Lock()
+		c, exist := l.conns[key]
+		if !exist {
+			c = &udpClientConn{
+				l:       l,
+				addr:    addr,
+				key:     key,
+				packets: make(chan []byte, _CHANNEL_SIZE),
+				done:    make(chan struct{}),
+				lock:    &sync.Mutex{},
+			}
+			select {
+			case l.acceptCh <- c:
+				l.conns[key] = c
+			default:
+				// backlog full, the client retries
+				c = nil
+			}
+		}
+		l.lock.Unlock()
+
+		// datagrams are dropped when the session lags behind
+		if c != nil {
+			select {
+			case c.packets <- data:
+			default:
+			}
+		}
+	}
+}
+
+func (l *udpListener) Accept() (net.Conn, error) {
+	if c, ok := <-l.acceptCh; ok {
+		return c, nil
+	}
+	return nil, l.err
+}
+
+func (l *udpListener) Close() error {
+	return l.pc.Close()
+}
+
+func (l *udpListener) Addr() net.Addr {
+	return l.pc.LocalAddr()
+}
+
+func (l *udpListener) remove(key string) {
+	l.lock.Lock()
+	delete(l.conns, key)
+	l.lock.Unlock()
+}
+
+// udpClientConn is the session of one client address.
+type udpClientConn struct {
+	l    *udpListener
+	addr net.Addr
+	key  string
+
+	packets      chan []byte
+	done         chan struct{}
+	closeOnce    sync.Once
+	readDeadline time.Time
+	lock         *sync.Mutex
+}
+
+func (c *udpClientConn) Read(b []byte) (n int, err error) {
+	c.lock.Lock()
+	deadline := c.readDeadline
+	c.lock.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case data := <-c.packets:
+		return copy(b, data), nil
+	case <-c.done:
+		return 0, io.EOF
+	case <-timeout:
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *udpClientConn) Write(b []byte) (int, error) {
+	return c.l.pc.WriteTo(b, c.addr)
+}
+
+func (c *udpClientConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.l.remove(c.key)
+	})
+	return nil
+}
+
+func (c *udpClientConn) LocalAddr() net.Addr  { return c.l.pc.LocalAddr() }
+func (c *udpClientConn) RemoteAddr() net.Addr { return c.addr }
+
+func (c *udpClientConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *udpClientConn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	c.readDeadline = t
+	c.lock.Unlock()
+	return nil
+}
+
+func (c *udpClientConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// udpRelay carries the datagrams of pConn over the tunnel connection, each
+// prefixed by its 2 bytes length, until either side fails or no datagram
+// passed for idle.
+func udpRelay(pConn, tunnel net.Conn, idle time.Duration) {
+	last := time.Now().UnixNano()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		header := make([]byte, 2)
+		for {
+			if _, err := io.ReadFull(tunnel, header); err != nil {
+				break
+			}
+			data := make([]byte, binary.BigEndian.Uint16(header))
+			if _, err := io.ReadFull(tunnel, data); err != nil {
+				break
+			}
+			atomic.StoreInt64(&last, time.Now().UnixNano())
+			if _, err := pConn.Write(data); err != nil {
+				break
+			}
+		}
+		pConn.Close()
+		tunnel.Close()
+	}()
+
+	buf := make([]byte, 2+_UDP_MAX_DATAGRAM)
+	for {
+		pConn.SetReadDeadline(time.Now().Add(idle))
+		n, err := pConn.Read(buf[2:])
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() &&
+				time.Since(time.Unix(0, atomic.LoadInt64(&last))) < idle {
+				continue
+			}
+			break
+		}
+		atomic.StoreInt64(&last, time.Now().UnixNano())
+		binary.BigEndian.PutUint16(buf, uint16(n))
+		if _, err = tunnel.Write(buf[:2+n]); err != nil {
+			break
+		}
+	}
+	pConn.Close()
+	tunnel.Close()
+	<-done
+}
@@ -4,6 +4,7 @@ import (
 	"io"
 	"net"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -14,6 +15,7 @@ const (
 	_EVENT_M_NEW_SLAVER_CONN_ERR
 	_EVENT_M_PTUNNEL_CONN_ACK
 	_EVENT_M_BUILD_TUNNEL_REQ
+	_EVENT_M_API
 
 	_EVENT_S_ERROR
 	_EVENT_S_CONN_ERROR
@@ -21,6 +23,7 @@ const (
 	_EVENT_S_RECV_CMD_ERROR
 	_EVENT_S_SEND_DATA
 	_EVENT_S_PT_CONN_INFO
+	_EVENT_S_SERVICES_ACK
 
 	_EVENT_SA_ERROR
 	_EVENT_SA_BUILD_TUNNEL_REQ
@@ -29,12 +32,15 @@ const (
 	_EVENT_SA_TERMINATE
 	_EVENT_SA_SHUTDOWN
 	_EVENT_SA_NEW_PTUNNEL_CONN
+	_EVENT_SA_SERVICES
+	_EVENT_SA_API
 
 	_EVENT_PT_NEW_PTUNNEL_CONN
 	_EVENT_PT_ACCEPT_ERROR
 	_EVENT_PT_PTUNNEL_CONN_ACK
 	_EVENT_PT_SHUTDOWN
 	_EVENT_PT_TERMINATE
+	_EVENT_PT_API
 
 	_EVENT_PTC_PTUNNEL_CONN_ACK
 	_EVENT_PTC_CLOSE
@@ -73,6 +79,8 @@ type proxyTunnelConnInfo struct {
 	mAddr *address
 	sAddr *address
 	cid   connectionid
+	token []byte
+	udp   bool
 }
 
 type channelEvent struct {
@@ -86,6 +94,7 @@ func (e *channelEvent) sendTo(ch chan *channelEvent) {
 
 type address struct {
 	ip    []byte
+	host  string
 	port  [2]byte
 	atype byte
 }
@@ -95,10 +104,24 @@ func (addr *address) String() string {
 	if (addr.atype == ATYP_IPV4 && len(addr.ip) == 4) ||
 		(addr.atype == ATYP_IPV6 && len(addr.ip) == 16) {
 		return net.JoinHostPort(net.IP(addr.ip).String(), port)
+	} else if addr.atype == ATYP_DOMAIN && addr.host != "" {
+		return net.JoinHostPort(addr.host, port)
 	}
 	return ""
 }
 
+// bytes encodes the ATYP, ADDR and PORT of the protocol.
+func (addr *address) bytes() []byte {
+	buf := []byte{addr.atype}
+	if addr.atype == ATYP_DOMAIN {
+		buf = append(buf, byte(len(addr.host)))
+		buf = append(buf, addr.host...)
+	} else {
+		buf = append(buf, addr.ip...)
+	}
+	return append(buf, addr.port[:]...)
+}
+
 func waitForChanClean(ch chan *channelEvent) {
 	end := time.After(_NETWORK_TIMEOUT + 1*time.Second)
 	for {
@@ -113,38 +136,58 @@ func waitForChanClean(ch chan *channelEvent) {
 	}
 }
 
-func sendData(ctrl net.Conn, bytesCh chan []byte,
+// sendData writes the commands of bytesCh to ctrl until done is closed,
+// bytesCh itself is never closed, see queueData.
+func sendData(ctrl net.Conn, bytesCh chan []byte, done chan struct{},
 	ch chan *channelEvent) {
-	for d := range bytesCh {
-		ctrl.SetWriteDeadline(time.Now().Add(_NETWORK_TIMEOUT))
-		if _, err := ctrl.Write(d); err != nil {
-			(&channelEvent{_EVENT_X_SEND_DATA_ERR, err}).sendTo(ch)
+	for {
+		select {
+		case d := <-bytesCh:
+			ctrl.SetWriteDeadline(time.Now().Add(_NETWORK_TIMEOUT))
+			if _, err := ctrl.Write(d); err != nil {
+				(&channelEvent{_EVENT_X_SEND_DATA_ERR, err}).sendTo(ch)
+			}
+		case <-done:
+			return
 		}
 	}
 }
 
+// queueData passes data to sendData, it drops data once done is closed.
+func queueData(bytesCh chan []byte, done chan struct{}, data []byte) {
+	select {
+	case bytesCh <- data:
+	case <-done:
+	}
+}
+
 func parseAddr(s string) (addr *address) {
 	host, port, err := net.SplitHostPort(s)
 	if err != nil {
 		return nil
 	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil
+	}
 
-	ip := net.ParseIP(host)
+	// a host name is resolved by the slaver
 	addr = &address{}
-	for i := 0; i < len(host); i++ {
-		if host[i] == '.' {
-			addr.atype = ATYP_IPV4
-			addr.ip = ip[net.IPv6len-net.IPv4len:]
-			break
-		} else if host[i] == ':' {
-			addr.atype = ATYP_IPV6
-			addr.ip = ip
-			break
+	if ip := net.ParseIP(host); ip == nil {
+		if host == "" || len(host) > 0xff {
+			return nil
 		}
+		addr.atype = ATYP_DOMAIN
+		addr.host = host
+	} else if ip4 := ip.To4(); ip4 != nil && !strings.Contains(host, ":") {
+		addr.atype = ATYP_IPV4
+		addr.ip = ip4
+	} else {
+		addr.atype = ATYP_IPV6
+		addr.ip = ip
 	}
-	p, _ := strconv.Atoi(port)
-	addr.port[0] = byte(uint16(p) >> 8)
-	addr.port[1] = byte(uint16(p) & 0xff)
+	addr.port[0] = byte(p >> 8)
+	addr.port[1] = byte(p & 0xff)
 
 	return
 }
@@ -0,0 +1,231 @@
+package reversetunnel
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"relay"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/solomonwzs/goxutil/logger"
+)
+
+var _BYTES_HTTP_NOT_FOUND = []byte("HTTP/1.1 404 Not Found\r\n" +
+	"Content-Length: 0\r\nConnection: close\r\n\r\n")
+
+// vhostRouter shares one master port between the http or https tunnels,
+// a connection goes to the tunnel of the Host header or of the TLS SNI.
+// TLS is not terminated by the master.
+type vhostRouter struct {
+	listener net.Listener
+	tls      bool
+
+	routes map[string]*vhostListener
+	lock   *sync.RWMutex
+}
+
+func newVhostRouter(addr string, tls bool) (r *vhostRouter, err error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return
+	}
+	return &vhostRouter{
+		listener: l,
+		tls:      tls,
+		routes:   map[string]*vhostListener{},
+		lock:     &sync.RWMutex{},
+	}, nil
+}
+
+// validDomain accepts a host name, or a wildcard "*.<host name>" matching
+// every name below it.
+func validDomain(domain string) bool {
+	name := strings.TrimPrefix(domain, "*.")
+	return name != "" && len(domain) <= 0xff &&
+		!strings.ContainsAny(name, "*:/ ") && net.ParseIP(name) == nil
+}
+
+// listen returns the listener of a tunnel for domains, none of which may
+// be taken by another tunnel.
+func (r *vhostRouter) listen(domains []string) (l *vhostListener, err error) {
+	if len(domains) == 0 {
+		return nil, ErrDomain
+	}
+	keys := make([]string, len(domains))
+	for i, d := range domains {
+		if keys[i] = strings.ToLower(d); !validDomain(keys[i]) {
+			return nil, ErrDomain
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, k := range keys {
+		if _, exist := r.routes[k]; exist {
+			return nil, ErrDomainExist
+		}
+	}
+	l = &vhostListener{
+		r:        r,
+		domains:  keys,
+		acceptCh: make(chan net.Conn, _CHANNEL_SIZE),
+		done:     make(chan struct{}),
+		lock:     &sync.Mutex{},
+	}
+	for _, k := range keys {
+		r.routes[k] = l
+	}
+	return
+}
+
+func (r *vhostRouter) remove(l *vhostListener) {
+	r.lock.Lock()
+	for _, k := range l.domains {
+		if r.routes[k] == l {
+			delete(r.routes, k)
+		}
+	}
+	r.lock.Unlock()
+}
+
+// lookup tries the host itself, then the wildcards from the closest.
+func (r *vhostRouter) lookup(host string) *vhostListener {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	if l, exist := r.routes[host]; exist {
+		return l
+	}
+	for i := strings.IndexByte(host, '.'); i >= 0; {
+		host = host[i+1:]
+		if l, exist := r.routes["*."+host]; exist {
+			return l
+		}
+		i = strings.IndexByte(host, '.')
+	}
+	return nil
+}
+
+func (r *vhostRouter) serve() {
+	for {
+		if conn, err := r.listener.Accept(); err != nil {
+			logger.Error(err)
+			return
+		} else {
+			go r.route(conn)
+		}
+	}
+}
+
+func (r *vhostRouter) route(conn net.Conn) {
+	buf := make([]byte, relay.SNIFF_BUFFER_SIZE)
+	n := 0
+	host := ""
+
+	conn.SetReadDeadline(time.Now().Add(_NETWORK_TIMEOUT))
+	for n < len(buf) {
+		m, err := conn.Read(buf[n:])
+		n += m
+		h, more := relay.SniffHost(buf[:n])
+		if h != "" {
+			host = h
+			break
+		} else if !more || err != nil {
+			break
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	if l := r.lookup(host); l != nil {
+		l.push(&peekedConn{conn, io.MultiReader(bytes.NewReader(buf[:n]),
+			conn)})
+		return
+	}
+	if !r.tls {
+		conn.SetWriteDeadline(time.Now().Add(_NETWORK_TIMEOUT))
+		conn.Write(_BYTES_HTTP_NOT_FOUND)
+	}
+	conn.Close()
+}
+
+// vhostListener takes the connections routed to a tunnel.
+type vhostListener struct {
+	r        *vhostRouter
+	domains  []string
+	acceptCh chan net.Conn
+	done     chan struct{}
+	closed   bool
+	lock     *sync.Mutex
+}
+
+func (l *vhostListener) push(conn net.Conn) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.closed {
+		conn.Close()
+		return
+	}
+	select {
+	case l.acceptCh <- conn:
+	default:
+		// backlog full
+		conn.Close()
+	}
+}
+
+func (l *vhostListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.acceptCh:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the connections not accepted yet too.
+func (l *vhostListener) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	l.r.remove(l)
+	close(l.done)
+	for {
+		select {
+		case conn := <-l.acceptCh:
+			conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func (l *vhostListener) Addr() net.Addr {
+	return l.r.listener.Addr()
+}
+
+// peekedConn reads the bytes peeked by the router before the connection.
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *peekedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
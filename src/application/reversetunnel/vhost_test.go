@@ -0,0 +1,200 @@
+package reversetunnel
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestVhostRouter(t *testing.T, tls bool) *vhostRouter {
+	r, err := newVhostRouter("127.0.0.1:0", tls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// closedPeer reports whether the peer of a pipe end was closed.
+func closedPeer(c net.Conn) bool {
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := c.Read(make([]byte, 1))
+	return err == io.EOF || err == io.ErrClosedPipe
+}
+
+func TestVhostLookup(t *testing.T) {
+	r := newTestVhostRouter(t, false)
+	defer r.listener.Close()
+
+	routes := map[string]*vhostListener{}
+	for _, d := range []string{"Example.com", "*.example.com",
+		"*.b.example.com", "a.b.example.com"} {
+		l, err := r.listen([]string{d})
+		if err != nil {
+			t.Fatalf("%s: %v", d, err)
+		}
+		routes[d] = l
+	}
+
+	cases := []struct {
+		host  string
+		route string
+	}{
+		{"example.com", "Example.com"},
+		{"EXAMPLE.COM.", "Example.com"},
+		{"x.example.com", "*.example.com"},
+		{"x.y.example.com", "*.example.com"},
+		{"y.b.example.com", "*.b.example.com"},
+		{"a.b.example.com", "a.b.example.com"},
+		{"A.B.Example.Com.", "a.b.example.com"},
+		{"z.a.b.example.com", "*.b.example.com"},
+		{"b.example.com", "*.example.com"},
+		{"example.org", ""},
+		{"notexample.com", ""},
+		{"com", ""},
+		{"", ""},
+		{".", ""},
+	}
+	for _, c := range cases {
+		if l := r.lookup(c.host); l != routes[c.route] {
+			t.Errorf("%q: wrong route, want %q", c.host, c.route)
+		}
+	}
+
+	// a removed tunnel gives its domains back
+	routes["*.example.com"].Close()
+	if l := r.lookup("x.example.com"); l != nil {
+		t.Error("route of a closed listener")
+	}
+	if _, err := r.listen([]string{"*.EXAMPLE.com"}); err != nil {
+		t.Errorf("domain of a closed listener: %v", err)
+	}
+}
+
+func TestVhostListen(t *testing.T) {
+	r := newTestVhostRouter(t, false)
+	defer r.listener.Close()
+	if _, err := r.listen([]string{"a.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		domains []string
+		err     error
+	}{
+		{nil, ErrDomain},
+		{[]string{""}, ErrDomain},
+		{[]string{"*."}, ErrDomain},
+		{[]string{"*.*.example.com"}, ErrDomain},
+		{[]string{"a*.example.com"}, ErrDomain},
+		{[]string{"example.com:80"}, ErrDomain},
+		{[]string{"127.0.0.1"}, ErrDomain},
+		{[]string{"b.example.com", "A.Example.Com"}, ErrDomainExist},
+	}
+	for _, c := range cases {
+		if _, err := r.listen(c.domains); err != c.err {
+			t.Errorf("%v: %v", c.domains, err)
+		}
+	}
+	// a failed listen takes no domain
+	if _, err := r.listen([]string{"b.example.com"}); err != nil {
+		t.Errorf("domain of a failed listen: %v", err)
+	}
+}
+
+func TestVhostRoute(t *testing.T) {
+	for _, tls := range []bool{false, true} {
+		r := newTestVhostRouter(t, tls)
+		l, _ := r.listen([]string{"www.example.com"})
+
+		req := "GET / HTTP/1.1\r\nHost: WWW.example.com:8080\r\n\r\nbody"
+		client, conn := net.Pipe()
+		go r.route(conn)
+		client.Write([]byte(req))
+		accepted, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the peeked bytes come first
+		client.Close()
+		if b, _ := ioutil.ReadAll(accepted); string(b) != req {
+			t.Fatalf("tls %v: tunnel read %q", tls, b)
+		}
+
+		client, conn = net.Pipe()
+		go r.route(conn)
+		client.Write([]byte("GET / HTTP/1.1\r\nHost: other\r\n\r\n"))
+		b, _ := ioutil.ReadAll(client)
+		if tls && len(b) != 0 ||
+			!tls && string(b) != string(_BYTES_HTTP_NOT_FOUND) {
+			t.Fatalf("tls %v: unknown host got %q", tls, b)
+		}
+		l.Close()
+		r.listener.Close()
+	}
+}
+
+func TestVhostBacklog(t *testing.T) {
+	r := newTestVhostRouter(t, false)
+	defer r.listener.Close()
+	l, _ := r.listen([]string{"example.com"})
+
+	peers := []net.Conn{}
+	for i := 0; i < _CHANNEL_SIZE+1; i++ {
+		c, peer := net.Pipe()
+		l.push(c)
+		peers = append(peers, peer)
+	}
+	// the connection over the backlog is dropped
+	if !closedPeer(peers[_CHANNEL_SIZE]) {
+		t.Fatal("connection over the backlog kept")
+	}
+
+	// and the ones not accepted yet are closed with the listener
+	if _, err := l.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	if !closedPeer(peers[1]) || !closedPeer(peers[_CHANNEL_SIZE-1]) {
+		t.Fatal("backlog kept after close")
+	}
+	if _, err := l.Accept(); err != net.ErrClosed {
+		t.Fatalf("accept after close: %v", err)
+	}
+}
+
+func TestVhostCloseRace(t *testing.T) {
+	r := newTestVhostRouter(t, false)
+	defer r.listener.Close()
+
+	for i := 0; i < 20; i++ {
+		l, err := r.listen([]string{"example.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		peers := make(chan net.Conn, 10)
+		wg := &sync.WaitGroup{}
+		for j := 0; j < cap(peers); j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c, peer := net.Pipe()
+				l.push(c)
+				peers <- peer
+			}()
+		}
+		l.Close()
+		wg.Wait()
+		close(peers)
+
+		// every connection pushed before or after the close is closed
+		for peer := range peers {
+			if !closedPeer(peer) {
+				t.Fatal("connection pushed while closing kept open")
+			}
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package socks5proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"relay/socks5"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	"github.com/solomonwzs/goxutil/logger"
+)
+
+type adminSessionInfo struct {
+	Listener string `json:"listener"`
+	*socks5.SessionInfo
+}
+
+type adminUserStat struct {
+	Sessions int   `json:"sessions"`
+	Up       int64 `json:"up"`   // active sessions only
+	Down     int64 `json:"down"` // active sessions only
+
+	// counters of the accounting, when enabled
+	Total *socks5.UserStat `json:"total,omitempty"`
+}
+
+type adminHttp struct {
+	s *proxyServer
+}
+
+func (s *proxyServer) serveAdmin() {
+	logger.Infof("socks5proxy: admin api on %s\n", s.adminAddr)
+	if err := http.ListenAndServe(s.adminAddr, &adminHttp{s}); err != nil {
+		logger.Errorf("socks5proxy: admin api: %s\n", err)
+	}
+}
+
+func (a *adminHttp) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Errorf("%v %v\n%s", r.URL.Path, err,
+				string(debug.Stack()))
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}()
+
+	if r.URL.Path == "/sessions" && r.Method == "GET" {
+		a.listSessionsHandler(w, r)
+	} else if strings.HasPrefix(r.URL.Path, "/sessions/") &&
+		r.Method == "DELETE" {
+		a.killSessionHandler(w, r)
+	} else if r.URL.Path == "/users" && r.Method == "GET" {
+		a.userStatsHandler(w, r)
+	} else {
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func writeJson(w http.ResponseWriter, httpStatus int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		logger.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus)
+	w.Write(data)
+}
+
+func (a *adminHttp) sessions() []*adminSessionInfo {
+	sessions := []*adminSessionInfo{}
+	for _, pl := range a.s.allListeners() {
+		for _, info := range pl.server.Sessions() {
+			sessions = append(sessions, &adminSessionInfo{pl.key, info})
+		}
+	}
+	return sessions
+}
+
+func (a *adminHttp) listSessionsHandler(w http.ResponseWriter,
+	r *http.Request) {
+	writeJson(w, http.StatusOK, a.sessions())
+}
+
+// DELETE /sessions/<id>
+func (a *adminHttp) killSessionHandler(w http.ResponseWriter,
+	r *http.Request) {
+	id, err := strconv.ParseUint(
+		strings.TrimPrefix(r.URL.Path, "/sessions/"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	for _, pl := range a.s.allListeners() {
+		if pl.server.Kill(id) {
+			logger.Infof("socks5proxy: session %d killed\n", id)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
+
+func (a *adminHttp) userStatsHandler(w http.ResponseWriter,
+	r *http.Request) {
+	stats := map[string]*adminUserStat{}
+	stat := func(user string) *adminUserStat {
+		if _, exist := stats[user]; !exist {
+			stats[user] = &adminUserStat{}
+		}
+		return stats[user]
+	}
+
+	for _, info := range a.sessions() {
+		st := stat(info.User)
+		st.Sessions += 1
+		st.Up += info.Up
+		st.Down += info.Down
+	}
+	if acct := a.s.getAccounting(); acct != nil {
+		for user, total := range acct.Stats() {
+			stat(user).Total = total
+		}
+	}
+
+	writeJson(w, http.StatusOK, stats)
+}
@@ -0,0 +1,156 @@
+package socks5proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"relay/socks5"
+	"time"
+)
+
+type listenerConfig struct {
+	// "tcp" or "unix", default "tcp"
+	Network string `json:"network,omitempty"`
+	Addr    string `json:"addr"`
+
+	Users     map[string]string       `json:"users,omitempty"`
+	Router    *socks5.RouterConfig    `json:"router,omitempty"`
+	RateLimit *socks5.RateLimitConfig `json:"rate_limit,omitempty"`
+	Timeout   *timeoutConfig          `json:"timeout,omitempty"`
+
+	// source ip and/or interface of direct outbounds without their own
+	BindAddr      string `json:"bind_addr,omitempty"`
+	BindInterface string `json:"bind_interface,omitempty"`
+
+	// sniff the TLS SNI or HTTP Host of sessions to an ip
+	Sniff bool `json:"sniff,omitempty"`
+
+	// "redirect" or "tproxy" to take connections diverted by iptables
+	// instead of socks clients, tcp only
+	Transparent string `json:"transparent,omitempty"`
+
+	// socks over tls, the common name of a verified client certificate
+	// is the user
+	TLS *socks5.TLSConfig `json:"tls,omitempty"`
+}
+
+// timeouts in seconds, see socks5.Options
+type timeoutConfig struct {
+	Handshake int `json:"handshake,omitempty"`
+	Dial      int `json:"dial,omitempty"`
+	Idle      int `json:"idle,omitempty"`
+	KeepAlive int `json:"keepalive,omitempty"`
+
+	// milliseconds
+	Sniff int `json:"sniff,omitempty"`
+}
+
+func (lc *listenerConfig) key() string {
+	// a tproxy listener needs a socket of its own
+	if lc.Transparent == socks5.TRANSPARENT_TPROXY {
+		return lc.Transparent + "://" + lc.Addr
+	}
+	return lc.Network + "://" + lc.Addr
+}
+
+type config struct {
+	Resolver   *socks5.ResolverConfig   `json:"resolver,omitempty"`
+	Accounting *socks5.AccountingConfig `json:"accounting,omitempty"`
+	Listeners  []*listenerConfig        `json:"listeners,omitempty"`
+
+	// bytes per second of all listeners, 0 means unlimited
+	GlobalRate uint64 `json:"global_rate,omitempty"`
+
+	// bytes per second of each user over all listeners
+	UserRate uint64 `json:"user_rate,omitempty"`
+
+	// seconds to wait for sessions to end on SIGINT or SIGTERM
+	ShutdownTimeout int `json:"shutdown_timeout,omitempty"`
+
+	// http admin api, disabled when empty
+	AdminAddr string `json:"admin_addr,omitempty"`
+
+	// one json line per session, disabled when nil
+	AccessLog *socks5.AccessLogConfig `json:"access_log,omitempty"`
+}
+
+func loadConfig(file string) (conf *config, err error) {
+	conf = new(config)
+	if file != "" {
+		var data []byte
+		if data, err = ioutil.ReadFile(file); err != nil {
+			return nil, err
+		} else if err = json.Unmarshal(data, conf); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(conf.Listeners) == 0 {
+		conf.Listeners = []*listenerConfig{{Addr: ":18081"}}
+	}
+	keys := map[string]bool{}
+	for _, lc := range conf.Listeners {
+		if lc.Network == "" {
+			lc.Network = "tcp"
+		}
+		if keys[lc.key()] {
+			return nil, fmt.Errorf("socks5proxy: duplicate listener %s",
+				lc.key())
+		}
+		keys[lc.key()] = true
+		switch lc.Transparent {
+		case "":
+		case socks5.TRANSPARENT_REDIRECT, socks5.TRANSPARENT_TPROXY:
+			if lc.Network == "unix" || lc.TLS != nil {
+				return nil, fmt.Errorf(
+					"socks5proxy: transparent listener %s is not plain tcp",
+					lc.Addr)
+			}
+		default:
+			return nil, fmt.Errorf(
+				"socks5proxy: unknown transparent mode %q", lc.Transparent)
+		}
+	}
+	return
+}
+
+// newOptions builds the handler options of a listener, all listeners share
+// one resolver, one accounting and one access log.
+func (lc *listenerConfig) newOptions(resolver socks5.Resolver,
+	acct *socks5.Accounting, limiter *socks5.RateLimiter,
+	accessLog socks5.AccessLogger) (opt *socks5.Options, err error) {
+	opt = &socks5.Options{
+		Resolver:    resolver,
+		Accounting:  acct,
+		RateLimiter: limiter,
+		AccessLog:   accessLog,
+		Sniff:       lc.Sniff,
+		Transparent: lc.Transparent,
+	}
+	if t := lc.Timeout; t != nil {
+		opt.HandshakeTimeout = time.Duration(t.Handshake) * time.Second
+		opt.DialTimeout = time.Duration(t.Dial) * time.Second
+		opt.IdleTimeout = time.Duration(t.Idle) * time.Second
+		opt.KeepAlive = time.Duration(t.KeepAlive) * time.Second
+		opt.SniffTimeout = time.Duration(t.Sniff) * time.Millisecond
+	}
+	if len(lc.Users) > 0 {
+		opt.Auth = socks5.StaticAuthenticator(lc.Users)
+	}
+	if lc.TLS != nil {
+		if opt.TLS, err = lc.TLS.ServerConfig(); err != nil {
+			return nil, err
+		}
+	}
+	if lc.BindAddr != "" || lc.BindInterface != "" {
+		if opt.Dialer, err = socks5.NewBindDialer(lc.BindAddr,
+			lc.BindInterface); err != nil {
+			return nil, err
+		}
+	}
+	if opt.Router, err = socks5.NewRouter(lc.Router, resolver,
+		opt.Dialer); err != nil {
+		return nil, err
+	}
+	return
+}
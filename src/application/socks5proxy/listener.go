@@ -0,0 +1,64 @@
+package socks5proxy
+
+import (
+	"net"
+	"os"
+	"relay/socks5"
+
+	"github.com/solomonwzs/goxutil/logger"
+)
+
+type proxyListener struct {
+	l      net.Listener
+	key    string
+	opt    *socks5.Options
+	server *socks5.Server
+}
+
+func newProxyListener(lc *listenerConfig, opt *socks5.Options) (
+	pl *proxyListener, err error) {
+	if lc.Network == "unix" {
+		// remove the socket file left by an unclean exit
+		if fi, err := os.Stat(lc.Addr); err == nil &&
+			fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(lc.Addr)
+		}
+	}
+
+	pl = &proxyListener{
+		key:    lc.key(),
+		opt:    opt,
+		server: socks5.NewServer(opt),
+	}
+	if lc.Transparent == socks5.TRANSPARENT_TPROXY {
+		pl.l, err = socks5.ListenTProxy(lc.Network, lc.Addr)
+	} else {
+		pl.l, err = net.Listen(lc.Network, lc.Addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (pl *proxyListener) options() *socks5.Options {
+	return pl.opt
+}
+
+// setOptions replaces the options of new sessions, established sessions
+// keep the options they were accepted with.
+func (pl *proxyListener) setOptions(opt *socks5.Options) {
+	pl.opt = opt
+	pl.server.SetOptions(opt)
+}
+
+func (pl *proxyListener) serve() {
+	logger.Infof("socks5proxy: listen on %s\n", pl.key)
+	err := pl.server.Serve(pl.l)
+	logger.Infof("socks5proxy: stop listening on %s: %s\n", pl.key, err)
+}
+
+// Close stops accepting new clients, established sessions go on.
+func (pl *proxyListener) Close() error {
+	return pl.l.Close()
+}
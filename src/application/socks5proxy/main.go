@@ -1,50 +1,262 @@
 package socks5proxy
 
 import (
+	"context"
+	"flag"
 	"fmt"
-	"net"
+	"os"
+	"os/signal"
 	"relay/socks5"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/solomonwzs/goxutil/logger"
 )
 
-func Main() {
-	logger.NewLogger(func(r *logger.Record) {
-		fmt.Printf("%s", r)
-	})
+var _DEFAULT_SHUTDOWN_TIMEOUT = 10 * time.Second
+
+type proxyServer struct {
+	confFile        string
+	shutdownTimeout time.Duration
+	adminAddr       string
+	listeners       map[string]*proxyListener
+	accounting      *socks5.Accounting
+	accessLog       *socks5.FileAccessLog
+	globalRate      *socks5.TokenBucket
+	userRates       *socks5.UserRates
 
-	l, err := net.Listen("tcp", ":18081")
+	// listeners removed by a reload, whose sessions may still be running
+	retired []*proxyListener
+
+	// guards listeners and retired, which the admin api reads
+	lock *sync.Mutex
+}
+
+// reload applies the config file, listeners still declared get the new
+// options, new ones are opened and the others are closed. Sessions already
+// established are never interrupted.
+func (s *proxyServer) reload() (err error) {
+	conf, err := loadConfig(s.confFile)
 	if err != nil {
-		logger.Error(err)
 		return
 	}
 
-	for {
-		client, err := l.Accept()
-		if err != nil {
-			logger.Error(err)
+	// everything is built and the new listeners are bound first, nothing
+	// running changes unless the whole config is valid
+	shutdownTimeout := time.Duration(conf.ShutdownTimeout) * time.Second
+	if shutdownTimeout == 0 {
+		shutdownTimeout = _DEFAULT_SHUTDOWN_TIMEOUT
+	}
+
+	var resolver socks5.Resolver
+	if conf.Resolver != nil {
+		if resolver, err = socks5.NewResolver(conf.Resolver); err != nil {
+			return
+		}
+	}
+
+	// counters live as long as the process, a reload only changes quotas
+	acct := s.getAccounting()
+	if conf.Accounting != nil && acct == nil {
+		if acct, err = socks5.NewAccounting(conf.Accounting); err != nil {
 			return
 		}
+		defer func(acct *socks5.Accounting) {
+			if err != nil {
+				acct.Close()
+			}
+		}(acct)
+	}
+
+	// like the admin listener, the access log is only opened at start
+	fileLog := s.accessLog
+	if conf.AccessLog != nil && fileLog == nil {
+		if fileLog, err = socks5.NewFileAccessLog(conf.AccessLog); err != nil {
+			return
+		}
+		defer func(l *socks5.FileAccessLog) {
+			if err != nil {
+				l.Close()
+			}
+		}(fileLog)
+	}
+	var accessLog socks5.AccessLogger
+	if fileLog != nil {
+		accessLog = fileLog
+	}
+
+	// rate limiters keep their buckets across reloads
+	opts := map[string]*socks5.Options{}
+	for _, lc := range conf.Listeners {
+		var limiter *socks5.RateLimiter
+		if pl, exist := s.listeners[lc.key()]; exist {
+			limiter = pl.options().RateLimiter
+		} else {
+			limiter = socks5.NewRateLimiter(lc.RateLimit, s.globalRate,
+				s.userRates)
+		}
+
+		if opts[lc.key()], err = lc.newOptions(resolver, acct,
+			limiter, accessLog); err != nil {
+			return
+		}
+	}
+
+	listeners := map[string]*proxyListener{}
+	opened := []*proxyListener{}
+	for _, lc := range conf.Listeners {
+		key := lc.key()
+		if pl, exist := s.listeners[key]; exist {
+			listeners[key] = pl
+			continue
+		}
+		pl, err := newProxyListener(lc, opts[key])
+		if err != nil {
+			for _, pl := range opened {
+				pl.Close()
+			}
+			return err
+		}
+		listeners[key] = pl
+		opened = append(opened, pl)
+	}
+
+	// apply
+	if s.adminAddr == "" {
+		s.adminAddr = conf.AdminAddr
+	}
+	s.shutdownTimeout = shutdownTimeout
+	s.accessLog = fileLog
+	if acct != nil {
+		if conf.Accounting != nil {
+			acct.SetQuotas(conf.Accounting.Quotas)
+		} else {
+			acct.SetQuotas(nil)
+		}
+	}
+	s.globalRate.SetRate(float64(conf.GlobalRate), 0)
+	s.userRates.SetRate(conf.UserRate)
+	for _, lc := range conf.Listeners {
+		key := lc.key()
+		if pl, exist := s.listeners[key]; exist {
+			pl.options().RateLimiter.SetConfig(lc.RateLimit)
+			pl.setOptions(opts[key])
+		}
+	}
+	for _, pl := range opened {
+		go pl.serve()
+	}
+
+	s.lock.Lock()
+	s.accounting = acct
+	for key, pl := range s.listeners {
+		if _, exist := listeners[key]; !exist {
+			pl.Close()
+			s.retired = append(s.retired, pl)
+			go s.drain(pl)
+		}
+	}
+	s.listeners = listeners
+	s.lock.Unlock()
+
+	return nil
+}
 
-		go func() {
-			var handler *socks5.TCPHandler = nil
+// drain waits for the sessions of the retired pl to end, then forgets it.
+func (s *proxyServer) drain(pl *proxyListener) {
+	pl.server.Shutdown(context.Background())
 
-			defer func() {
-				if err := recover(); err != nil {
-					logger.Error(err)
-				}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, r := range s.retired {
+		if r == pl {
+			s.retired = append(s.retired[:i], s.retired[i+1:]...)
+			break
+		}
+	}
+}
+
+func (s *proxyServer) getAccounting() *socks5.Accounting {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.accounting
+}
+
+// allListeners returns the current and the retired listeners.
+func (s *proxyServer) allListeners() []*proxyListener {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	all := append([]*proxyListener{}, s.retired...)
+	for _, pl := range s.listeners {
+		all = append(all, pl)
+	}
+	return all
+}
 
-				if handler != nil {
-					handler.Close()
-				}
-			}()
+// shutdown stops all listeners and waits for their sessions to end, up to
+// the shutdown timeout.
+func (s *proxyServer) shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(),
+		s.shutdownTimeout)
+	defer cancel()
 
-			handler = socks5.NewTCPHandler(client)
-			if handler == nil {
-				return
+	wg := &sync.WaitGroup{}
+	for _, pl := range s.allListeners() {
+		wg.Add(1)
+		go func(pl *proxyListener) {
+			defer wg.Done()
+			if err := pl.server.Shutdown(ctx); err != nil {
+				logger.Errorf("socks5proxy: shutdown %s: %s\n", pl.key, err)
 			}
+		}(pl)
+	}
+	wg.Wait()
+}
+
+func Main() {
+	logger.NewLogger(func(r *logger.Record) {
+		fmt.Printf("%s", r)
+	})
+
+	confFile := flag.String("f", "", "config file")
+	flag.Parse()
+
+	s := &proxyServer{
+		confFile:   *confFile,
+		listeners:  map[string]*proxyListener{},
+		globalRate: socks5.NewTokenBucket(0, 0),
+		userRates:  socks5.NewUserRates(0),
+		lock:       &sync.Mutex{},
+	}
+	if err := s.reload(); err != nil {
+		panic(err)
+	}
+	if len(s.listeners) == 0 {
+		panic("socks5proxy: no listener")
+	}
+	if s.adminAddr != "" {
+		go s.serveAdmin()
+	}
 
-			handler.Run()
-		}()
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	for sig := range sigCh {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		logger.Info("socks5proxy: reload config")
+		if err := s.reload(); err != nil {
+			logger.Errorf("socks5proxy: reload config error: %s\n", err)
+		}
+	}
+
+	s.shutdown()
+	if s.accounting != nil {
+		s.accounting.Close()
+	}
+	if s.accessLog != nil {
+		s.accessLog.Close()
 	}
 }
@@ -0,0 +1,192 @@
+package relay
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Directions of a relay between a and b.
+const (
+	DIR_UP   = iota // from a to b
+	DIR_DOWN        // from b to a
+)
+
+// Why a relay ended.
+const (
+	CLOSE_EOF   = iota // both sides closed their write side
+	CLOSE_IDLE         // no data in both directions for IdleTimeout
+	CLOSE_ERROR        // a read or write failed, see Result.Err
+)
+
+const _BUFFER_SIZE = 32 * 1024
+
+var ErrIdleTimeout = errors.New("relay: idle timeout")
+
+var _BUFFER_POOL = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, _BUFFER_SIZE)
+		return &b
+	},
+}
+
+// Hook is called with every chunk of n bytes read in direction dir, before
+// it is written. Accounting counts in it, limiters block in it.
+type Hook func(dir int, n int)
+
+type Options struct {
+	Hooks []Hook
+
+	// zero never times out
+	IdleTimeout time.Duration
+}
+
+type Result struct {
+	Up     int64
+	Down   int64
+	Reason int
+	Err    error
+}
+
+func (r *Result) ReasonString() string {
+	switch r.Reason {
+	case CLOSE_EOF:
+		return "eof"
+	case CLOSE_IDLE:
+		return "idle"
+	default:
+		if r.Err != nil {
+			return r.Err.Error()
+		}
+		return "error"
+	}
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+type relayer struct {
+	opt  *Options
+	last int64 // unix nano of the last data, both directions
+
+	errOnce sync.Once
+	err     error
+}
+
+// Relay copies data between a and b in both directions until both sides
+// have closed their write side, a side reaching EOF is propagated with
+// CloseWrite so half-closed connections keep working. On error or idle
+// timeout both connections are closed. Linux tcp to tcp copies use
+// splice(2).
+func Relay(a, b net.Conn, opt *Options) *Result {
+	if opt == nil {
+		opt = &Options{}
+	}
+	r := &relayer{opt: opt, last: time.Now().UnixNano()}
+	res := &Result{}
+
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		res.Up = r.halfRelay(b, a, DIR_UP)
+		wg.Done()
+	}()
+	res.Down = r.halfRelay(a, b, DIR_DOWN)
+	wg.Done()
+	wg.Wait()
+
+	if r.err == nil {
+		res.Reason = CLOSE_EOF
+	} else if r.err == ErrIdleTimeout {
+		res.Reason = CLOSE_IDLE
+	} else {
+		res.Reason, res.Err = CLOSE_ERROR, r.err
+	}
+	return res
+}
+
+func (r *relayer) halfRelay(dst, src net.Conn, dir int) int64 {
+	n, err := r.copy(dst, src, dir)
+	if err == nil {
+		if c, ok := dst.(closeWriter); ok {
+			c.CloseWrite()
+			return n
+		}
+	}
+
+	// an EOF without half close must not hide the error of the other way
+	if err != nil {
+		r.errOnce.Do(func() { r.err = err })
+	}
+	dst.Close()
+	src.Close()
+	return n
+}
+
+func (r *relayer) copy(dst, src net.Conn, dir int) (written int64,
+	err error) {
+	if n, handled, err := spliceCopy(dst, src, r, dir); handled {
+		return n, err
+	}
+
+	bp := _BUFFER_POOL.Get().(*[]byte)
+	defer _BUFFER_POOL.Put(bp)
+	buf := *bp
+
+	for {
+		r.setReadDeadline(src)
+		nr, er := src.Read(buf)
+		if nr > 0 {
+			r.moved(dir, nr)
+			nw, ew := dst.Write(buf[:nr])
+			written += int64(nw)
+			if ew != nil {
+				return written, ew
+			} else if nw != nr {
+				return written, io.ErrShortWrite
+			}
+		}
+		if er == io.EOF {
+			return written, nil
+		} else if er != nil {
+			if r.idle(er) {
+				return written, ErrIdleTimeout
+			} else if r.isTimeout(er) {
+				continue
+			}
+			return written, er
+		}
+	}
+}
+
+func (r *relayer) setReadDeadline(src net.Conn) {
+	if r.opt.IdleTimeout > 0 {
+		src.SetReadDeadline(time.Now().Add(r.opt.IdleTimeout))
+	}
+}
+
+func (r *relayer) moved(dir int, n int) {
+	atomic.StoreInt64(&r.last, time.Now().UnixNano())
+	for _, h := range r.opt.Hooks {
+		h(dir, n)
+	}
+}
+
+func (r *relayer) isTimeout(err error) bool {
+	e, ok := err.(net.Error)
+	return ok && e.Timeout() && r.opt.IdleTimeout > 0
+}
+
+// idle reports whether err is a read timeout and the opposite direction has
+// not moved data either for IdleTimeout.
+func (r *relayer) idle(err error) bool {
+	if !r.isTimeout(err) {
+		return false
+	}
+	last := time.Unix(0, atomic.LoadInt64(&r.last))
+	return time.Since(last) >= r.opt.IdleTimeout
+}
@@ -0,0 +1,172 @@
+package relay
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// bufferedConn hides the *net.TCPConn type, which keeps the relay off the
+// splice path but keeps CloseWrite.
+type bufferedConn struct {
+	*net.TCPConn
+}
+
+// tcpPair returns both ends of a loopback tcp connection.
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := ln.Accept()
+		accepted <- c
+	}()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := <-accepted
+	if s == nil {
+		t.Fatal("accept failed")
+	}
+	return c.(*net.TCPConn), s.(*net.TCPConn)
+}
+
+// relayPair starts a relay between a client and a server, the returned
+// channel gets the result.
+func relayPair(t *testing.T, splice bool, opt *Options) (
+	client, server *net.TCPConn, done chan *Result) {
+	client, a := tcpPair(t)
+	b, server := tcpPair(t)
+
+	var ra, rb net.Conn = a, b
+	if !splice {
+		ra, rb = bufferedConn{a}, bufferedConn{b}
+	}
+	done = make(chan *Result, 1)
+	go func() { done <- Relay(ra, rb, opt) }()
+	return
+}
+
+func waitResult(t *testing.T, done chan *Result) *Result {
+	select {
+	case res := <-done:
+		return res
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay did not end")
+	}
+	return nil
+}
+
+func TestRelayHalfClose(t *testing.T) {
+	for _, splice := range []bool{true, false} {
+		client, server, done := relayPair(t, splice, nil)
+
+		client.Write([]byte("request"))
+		client.CloseWrite()
+		data, err := ioutil.ReadAll(server)
+		if err != nil || string(data) != "request" {
+			t.Fatalf("splice %v: server read %q, %v", splice, data, err)
+		}
+
+		// the server still answers after the client half closed
+		server.Write([]byte("response"))
+		server.CloseWrite()
+		data, err = ioutil.ReadAll(client)
+		if err != nil || string(data) != "response" {
+			t.Fatalf("splice %v: client read %q, %v", splice, data, err)
+		}
+
+		res := waitResult(t, done)
+		if res.Reason != CLOSE_EOF || res.Up != 7 || res.Down != 8 {
+			t.Fatalf("splice %v: result %+v", splice, res)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestRelayBytes(t *testing.T) {
+	up := bytes.Repeat([]byte("u"), 3<<20+17)
+	down := bytes.Repeat([]byte("d"), 100*1024)
+
+	for _, splice := range []bool{true, false} {
+		var hookUp, hookDown int64
+		opt := &Options{Hooks: []Hook{func(dir int, n int) {
+			if dir == DIR_UP {
+				atomic.AddInt64(&hookUp, int64(n))
+			} else {
+				atomic.AddInt64(&hookDown, int64(n))
+			}
+		}}}
+		client, server, done := relayPair(t, splice, opt)
+
+		go func() {
+			client.Write(up)
+			client.CloseWrite()
+		}()
+		go func() {
+			server.Write(down)
+			server.CloseWrite()
+		}()
+		gotUp, _ := ioutil.ReadAll(server)
+		gotDown, _ := ioutil.ReadAll(client)
+		if !bytes.Equal(gotUp, up) || !bytes.Equal(gotDown, down) {
+			t.Fatalf("splice %v: read %d and %d bytes", splice, len(gotUp),
+				len(gotDown))
+		}
+
+		res := waitResult(t, done)
+		if res.Up != int64(len(up)) || res.Down != int64(len(down)) {
+			t.Fatalf("splice %v: result %+v", splice, res)
+		}
+		if hookUp != res.Up || hookDown != res.Down {
+			t.Fatalf("splice %v: hooks counted %d and %d bytes", splice,
+				hookUp, hookDown)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestRelayIdleTimeout(t *testing.T) {
+	for _, splice := range []bool{true, false} {
+		opt := &Options{IdleTimeout: 200 * time.Millisecond}
+		client, server, done := relayPair(t, splice, opt)
+
+		// data in one direction keeps the other one alive
+		for i := 0; i < 3; i++ {
+			time.Sleep(100 * time.Millisecond)
+			client.Write([]byte("x"))
+		}
+		select {
+		case res := <-done:
+			t.Fatalf("splice %v: ended while active: %+v", splice, res)
+		default:
+		}
+
+		start := time.Now()
+		res := waitResult(t, done)
+		if res.Reason != CLOSE_IDLE || res.ReasonString() != "idle" {
+			t.Fatalf("splice %v: result %+v", splice, res)
+		} else if d := time.Since(start); d > time.Second {
+			t.Fatalf("splice %v: idle after %v", splice, d)
+		}
+
+		// both connections are closed
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.Copy(ioutil.Discard, client); err != nil {
+			t.Fatalf("splice %v: client not closed: %v", splice, err)
+		}
+		client.Close()
+		server.Close()
+	}
+}
@@ -0,0 +1,152 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+)
+
+// SniffHost gives up on a request header or a ClientHello longer than this.
+const SNIFF_BUFFER_SIZE = 8192
+
+var _HTTP_METHODS = []string{"GET ", "POST ", "HEAD ", "PUT ", "DELETE ",
+	"OPTIONS ", "PATCH ", "CONNECT ", "TRACE "}
+
+// SniffHost looks for a host name in the first bytes a client sends, the
+// SNI of a TLS ClientHello or the Host header of a HTTP request. more is
+// true when data is a prefix of either and more bytes may tell.
+func SniffHost(data []byte) (host string, more bool) {
+	if len(data) == 0 {
+		return "", true
+	}
+	if data[0] == 0x16 {
+		return sniffTLS(data)
+	}
+	return sniffHTTP(data)
+}
+
+// The TLS record and ClientHello, RFC 5246 and RFC 6066:
+
+// +------+---------+--------+------+--------+---------+--------+-----+
+// | TYPE | VERSION | LENGTH | TYPE | LENGTH | VERSION | RANDOM | ... |
+// +------+---------+--------+------+--------+---------+--------+-----+
+// | X'16'|    2    |   2    | X'01'|   3    |    2    |   32   |     |
+// +------+---------+--------+------+--------+---------+--------+-----+
+
+// followed by the session id, cipher suites and compression methods, each
+// prefixed by its length, and the extensions. The server_name extension,
+// type X'0000', holds a list of names, a host_name has type X'00'.
+
+func sniffTLS(data []byte) (host string, more bool) {
+	if len(data) < 5 {
+		return "", true
+	}
+	recordLen := int(binary.BigEndian.Uint16(data[3:5]))
+	if len(data) < 5+recordLen {
+		return "", len(data) < SNIFF_BUFFER_SIZE
+	}
+	p := data[5 : 5+recordLen]
+
+	if len(p) < 4 || p[0] != 0x01 {
+		return "", false
+	}
+	p = p[4:]
+
+	// version and random
+	if len(p) < 34 {
+		return "", false
+	}
+	p = p[34:]
+
+	// session id, cipher suites and compression methods
+	for _, prefix := range []int{1, 2, 1} {
+		if len(p) < prefix {
+			return "", false
+		}
+		l := int(p[0])
+		if prefix == 2 {
+			l = int(binary.BigEndian.Uint16(p))
+		}
+		if len(p) < prefix+l {
+			return "", false
+		}
+		p = p[prefix+l:]
+	}
+
+	if len(p) < 2 {
+		return "", false
+	}
+	extLen := int(binary.BigEndian.Uint16(p))
+	p = p[2:]
+	if len(p) < extLen {
+		return "", false
+	}
+	p = p[:extLen]
+
+	for len(p) >= 4 {
+		typ := binary.BigEndian.Uint16(p)
+		l := int(binary.BigEndian.Uint16(p[2:]))
+		if len(p) < 4+l {
+			return "", false
+		}
+		ext := p[4 : 4+l]
+		p = p[4+l:]
+		if typ != 0x0000 || len(ext) < 2 {
+			continue
+		}
+
+		ext = ext[2:]
+		for len(ext) >= 3 {
+			nameType := ext[0]
+			nameLen := int(binary.BigEndian.Uint16(ext[1:]))
+			if len(ext) < 3+nameLen {
+				return "", false
+			}
+			if nameType == 0x00 {
+				return string(ext[3 : 3+nameLen]), false
+			}
+			ext = ext[3+nameLen:]
+		}
+	}
+	return "", false
+}
+
+func sniffHTTP(data []byte) (host string, more bool) {
+	isHTTP := false
+	for _, m := range _HTTP_METHODS {
+		n := len(m)
+		if len(data) < n {
+			n = len(data)
+		}
+		if bytes.Equal(data[:n], []byte(m[:n])) {
+			if len(data) < len(m) {
+				return "", true
+			}
+			isHTTP = true
+			break
+		}
+	}
+	if !isHTTP {
+		return "", false
+	}
+
+	end := bytes.Index(data, []byte("\r\n\r\n"))
+	if end < 0 {
+		end = len(data)
+		more = len(data) < SNIFF_BUFFER_SIZE
+	}
+	lines := strings.Split(string(data[:end]), "\r\n")
+	for _, line := range lines[1:] {
+		i := strings.IndexByte(line, ':')
+		if i < 0 || !strings.EqualFold(strings.TrimSpace(line[:i]), "host") {
+			continue
+		}
+		host = strings.TrimSpace(line[i+1:])
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return host, false
+	}
+	return "", more
+}
@@ -0,0 +1,73 @@
+package relay
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+)
+
+// clientHello returns the first record of a tls handshake to serverName.
+func clientHello(t *testing.T, serverName string) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+	go tls.Client(client, &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+	}).Handshake()
+
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, int(header[3])<<8|int(header[4]))
+	if _, err := io.ReadFull(server, body); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	return append(header, body...)
+}
+
+func TestSniffHost(t *testing.T) {
+	hello := clientHello(t, "www.example.com")
+	oversized := append([]byte{0x16, 0x03, 0x01, 0xff, 0xff},
+		make([]byte, SNIFF_BUFFER_SIZE-5)...)
+
+	cases := []struct {
+		name string
+		data []byte
+		host string
+		more bool
+	}{
+		{"empty", nil, "", true},
+		{"client hello", hello, "www.example.com", false},
+		{"truncated header", hello[:3], "", true},
+		{"truncated record", hello[:len(hello)-1], "", true},
+		{"record over buffer", oversized, "", false},
+		{"record under buffer", oversized[:100], "", true},
+		{"no sni", clientHello(t, ""), "", false},
+		{"not a client hello",
+			[]byte{0x16, 0x03, 0x01, 0x00, 0x04, 0x02, 0, 0, 0}, "", false},
+		{"http", []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"),
+			"example.com", false},
+		{"http port", []byte("POST /a HTTP/1.1\r\nhost: example.com:8080" +
+			"\r\nContent-Length: 0\r\n\r\n"), "example.com", false},
+		{"http ipv6 port", []byte("GET / HTTP/1.1\r\nHost: [::1]:80\r\n\r\n"),
+			"::1", false},
+		{"http no host", []byte("GET / HTTP/1.0\r\n\r\n"), "", false},
+		{"http partial method", []byte("OPTI"), "", true},
+		{"http partial header", []byte("GET / HTTP/1.1\r\nHo"), "", true},
+		{"http header over buffer", append([]byte("GET /"),
+			bytes.Repeat([]byte("a"), SNIFF_BUFFER_SIZE)...), "", false},
+		{"garbage", []byte("\x00\x01\x02garbage\r\n\r\n"), "", false},
+		{"ssh", []byte("SSH-2.0-OpenSSH_9.0\r\n"), "", false},
+	}
+	for _, c := range cases {
+		host, more := SniffHost(c.data)
+		if host != c.host || more != c.more {
+			t.Errorf("%s: got %q, %v, want %q, %v", c.name, host, more,
+				c.host, c.more)
+		}
+	}
+}
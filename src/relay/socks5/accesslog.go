@@ -0,0 +1,199 @@
+package socks5
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	ACCESS_LOG_ROTATE_HOURLY = "hourly"
+	ACCESS_LOG_ROTATE_DAILY  = "daily"
+)
+
+// AccessRecord describes a session once it has ended, Rep is -1 when no
+// reply was sent.
+type AccessRecord struct {
+	Time       time.Time `json:"time"`
+	ID         uint64    `json:"id"`
+	ClientAddr string    `json:"client_addr"`
+	User       string    `json:"user,omitempty"`
+	Command    string    `json:"command,omitempty"`
+	Dest       string    `json:"dest,omitempty"`
+	Sniffed    string    `json:"sniffed_host,omitempty"`
+	IP         string    `json:"ip,omitempty"`
+	Outbound   string    `json:"outbound,omitempty"`
+	Rep        int       `json:"rep"`
+	Up         int64     `json:"up"`
+	Down       int64     `json:"down"`
+	Duration   int64     `json:"duration_ms"`
+	Close      string    `json:"close,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+type AccessLogger interface {
+	Log(r *AccessRecord)
+}
+
+func commandName(cmd byte) string {
+	switch cmd {
+	case CMD_CONNECT:
+		return "connect"
+	case CMD_BIND:
+		return "bind"
+	case CMD_UDP_ASSOCIATE:
+		return "udp_associate"
+	case CMD_RESOLVE:
+		return "resolve"
+	case CMD_RESOLVE_PTR:
+		return "resolve_ptr"
+	case 0:
+		return ""
+	default:
+		return "unknown"
+	}
+}
+
+type AccessLogConfig struct {
+	// json lines are written to file, or to stdout when empty or "-"
+	File string `json:"file,omitempty"`
+
+	// rotate when the file reaches MaxSize bytes, 0 never does
+	MaxSize int64 `json:"max_size,omitempty"`
+
+	// "hourly" or "daily", empty never rotates by time
+	Rotate string `json:"rotate,omitempty"`
+
+	// rotated files kept, 0 keeps all of them
+	MaxBackups int `json:"max_backups,omitempty"`
+}
+
+// FileAccessLog writes one json line per record and rotates the file by
+// size or time, a rotated file is renamed with its rotation time.
+type FileAccessLog struct {
+	conf   AccessLogConfig
+	w      io.Writer
+	f      *os.File
+	size   int64
+	period string
+	lock   *sync.Mutex
+}
+
+func NewFileAccessLog(conf *AccessLogConfig) (l *FileAccessLog, err error) {
+	l = &FileAccessLog{lock: &sync.Mutex{}}
+	if conf != nil {
+		l.conf = *conf
+	}
+
+	if l.conf.File == "" || l.conf.File == "-" {
+		l.w = os.Stdout
+		return
+	}
+	if err = l.open(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (l *FileAccessLog) periodOf(t time.Time) string {
+	switch l.conf.Rotate {
+	case ACCESS_LOG_ROTATE_HOURLY:
+		return t.Format("2006010215")
+	case ACCESS_LOG_ROTATE_DAILY:
+		return t.Format("20060102")
+	default:
+		return ""
+	}
+}
+
+func (l *FileAccessLog) open() (err error) {
+	if l.f, err = os.OpenFile(l.conf.File,
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err != nil {
+		return
+	}
+
+	fi, err := l.f.Stat()
+	if err != nil {
+		l.f.Close()
+		return
+	}
+	l.w = l.f
+	l.size = fi.Size()
+	l.period = l.periodOf(fi.ModTime())
+	return
+}
+
+// rotate renames the file before closing it, records keep going to the
+// current file when the rename or the new file fails.
+func (l *FileAccessLog) rotate(now time.Time) (err error) {
+	backup := l.conf.File + "." + now.Format("20060102150405.000")
+	if err = os.Rename(l.conf.File, backup); err != nil {
+		return
+	}
+
+	f := l.f
+	if err = l.open(); err != nil {
+		l.f = f
+		return
+	}
+	f.Close()
+	l.removeBackups()
+	return
+}
+
+func (l *FileAccessLog) removeBackups() {
+	if l.conf.MaxBackups <= 0 {
+		return
+	}
+	backups, err := filepath.Glob(l.conf.File + ".*")
+	if err != nil || len(backups) <= l.conf.MaxBackups {
+		return
+	}
+	// the time suffixes sort in order
+	sort.Strings(backups)
+	for _, b := range backups[:len(backups)-l.conf.MaxBackups] {
+		os.Remove(b)
+	}
+}
+
+func (l *FileAccessLog) Log(r *AccessRecord) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	data = append(data, '\n')
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.f != nil {
+		now := time.Now()
+		if (l.conf.MaxSize > 0 && l.size > 0 &&
+			l.size+int64(len(data)) > l.conf.MaxSize) ||
+			(l.period != "" && l.periodOf(now) != l.period) {
+			if err = l.rotate(now); err != nil {
+				// retried after the next period or MaxSize bytes
+				defaultLogger{}.Error(err)
+				l.size = 0
+			}
+			l.period = l.periodOf(now)
+		}
+	}
+
+	n, _ := l.w.Write(data)
+	l.size += int64(n)
+}
+
+func (l *FileAccessLog) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.f != nil {
+		return l.f.Close()
+	}
+	return nil
+}
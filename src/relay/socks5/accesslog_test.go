@@ -0,0 +1,53 @@
+package socks5
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAccessLogRotate(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "access.log")
+	l, err := NewFileAccessLog(&AccessLogConfig{File: file, MaxSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	l.Log(&AccessRecord{ID: 1})
+	l.Log(&AccessRecord{ID: 2})
+	backups, _ := filepath.Glob(file + ".*")
+	if len(backups) != 1 {
+		t.Fatalf("%d backups", len(backups))
+	}
+	data, _ := ioutil.ReadFile(file)
+	if !strings.Contains(string(data), `"id":2`) {
+		t.Fatalf("current file: %s", data)
+	}
+}
+
+func TestAccessLogRotateError(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "access.log")
+	l, err := NewFileAccessLog(&AccessLogConfig{File: file, MaxSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.Log(&AccessRecord{ID: 1})
+
+	// the rename of a missing file fails, the open file keeps the records
+	link := filepath.Join(dir, "kept.log")
+	os.Link(file, link)
+	os.Remove(file)
+	l.Log(&AccessRecord{ID: 2})
+	l.Log(&AccessRecord{ID: 3})
+
+	data, _ := ioutil.ReadFile(link)
+	if !strings.Contains(string(data), `"id":2`) ||
+		!strings.Contains(string(data), `"id":3`) {
+		t.Fatalf("records dropped after a failed rotation: %s", data)
+	}
+}
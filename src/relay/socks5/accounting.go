@@ -0,0 +1,403 @@
+package socks5
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"relay"
+	"sync"
+	"time"
+)
+
+// QUOTA_DEFAULT_USER is the quota key applied to users without their own
+// entry.
+const QUOTA_DEFAULT_USER = "*"
+
+var (
+	_ACCOUNTING_INTERVAL = 60 * time.Second
+
+	// a meter passes its counts to the accounting in batches of this many
+	// bytes, or of this long, and when it is closed
+	_ACCOUNTING_FLUSH_BYTES    = uint64(64 * 1024)
+	_ACCOUNTING_FLUSH_INTERVAL = 1 * time.Second
+)
+
+// destinations of a user beyond AccountingConfig.Dests are counted under
+// this key
+const _ACCOUNTING_OTHER_DESTS = "*"
+
+type QuotaConfig struct {
+	// bytes sent and received, 0 means unlimited
+	Daily   uint64 `json:"daily,omitempty"`
+	Monthly uint64 `json:"monthly,omitempty"`
+
+	// concurrent sessions, 0 means unlimited
+	MaxSessions int `json:"max_sessions,omitempty"`
+}
+
+type AccountingConfig struct {
+	// counters are loaded from and saved to file when not empty
+	File string `json:"file,omitempty"`
+
+	// seconds between two saves
+	Interval int `json:"interval,omitempty"`
+
+	// per user quotas, keyed by user name or QUOTA_DEFAULT_USER
+	Quotas map[string]*QuotaConfig `json:"quotas,omitempty"`
+
+	// destinations counted apart per user, the others share one counter,
+	// 0 disables the destination counters
+	Dests int `json:"dests,omitempty"`
+}
+
+type TrafficStat struct {
+	Up   uint64 `json:"up"`
+	Down uint64 `json:"down"`
+}
+
+type UserStat struct {
+	TrafficStat
+
+	Day        string `json:"day"`
+	DayBytes   uint64 `json:"day_bytes"`
+	Month      string `json:"month"`
+	MonthBytes uint64 `json:"month_bytes"`
+
+	Dests map[string]*TrafficStat `json:"dests,omitempty"`
+
+	sessions int
+}
+
+func (s *UserStat) rollover(now time.Time) {
+	if day := now.Format("2006-01-02"); s.Day != day {
+		s.Day, s.DayBytes = day, 0
+	}
+	if month := now.Format("2006-01"); s.Month != month {
+		s.Month, s.MonthBytes = month, 0
+	}
+}
+
+// Accounting counts the traffic of every user and destination, and
+// enforces the user quotas, a session over quota is refused or closed.
+type Accounting struct {
+	file     string
+	interval time.Duration
+	dests    int
+
+	quotas map[string]*QuotaConfig
+	users  map[string]*UserStat
+	lock   *sync.Mutex
+	dirty  bool
+
+	closeCh chan struct{}
+}
+
+func NewAccounting(conf *AccountingConfig) (a *Accounting, err error) {
+	if conf == nil {
+		conf = &AccountingConfig{}
+	}
+
+	a = &Accounting{
+		file:     conf.File,
+		interval: time.Duration(conf.Interval) * time.Second,
+		dests:    conf.Dests,
+		quotas:   conf.Quotas,
+		users:    map[string]*UserStat{},
+		lock:     &sync.Mutex{},
+		closeCh:  make(chan struct{}),
+	}
+	if a.interval == 0 {
+		a.interval = _ACCOUNTING_INTERVAL
+	}
+
+	if a.file != "" {
+		if data, err := ioutil.ReadFile(a.file); err == nil {
+			if err = json.Unmarshal(data, &a.users); err != nil {
+				return nil, err
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+		go a.saveLoop()
+	}
+
+	return
+}
+
+func (a *Accounting) SetQuotas(quotas map[string]*QuotaConfig) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.quotas = quotas
+}
+
+func (a *Accounting) quota(user string) *QuotaConfig {
+	if q, exist := a.quotas[user]; exist {
+		return q
+	} else if q, exist := a.quotas[QUOTA_DEFAULT_USER]; exist {
+		return q
+	}
+	return &QuotaConfig{}
+}
+
+func (a *Accounting) userStat(user string) *UserStat {
+	s, exist := a.users[user]
+	if !exist {
+		s = &UserStat{}
+		a.users[user] = s
+	}
+	if s.Dests == nil && a.dests > 0 {
+		s.Dests = map[string]*TrafficStat{}
+	}
+	return s
+}
+
+func (a *Accounting) overQuota(q *QuotaConfig, s *UserStat) bool {
+	return (q.Daily > 0 && s.DayBytes >= q.Daily) ||
+		(q.Monthly > 0 && s.MonthBytes >= q.Monthly)
+}
+
+// Open starts a session of req.User to req.Host, it fails with ErrQuota
+// when the user is over quota or has too many sessions.
+func (a *Accounting) Open(req *Request) (m *Meter, err error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	q := a.quota(req.User)
+	s := a.userStat(req.User)
+	s.rollover(time.Now())
+	if a.overQuota(q, s) ||
+		(q.MaxSessions > 0 && s.sessions >= q.MaxSessions) {
+		return nil, ErrQuota
+	}
+	s.sessions += 1
+
+	return &Meter{
+		a:       a,
+		user:    req.User,
+		dest:    req.Host,
+		flushed: time.Now(),
+	}, nil
+}
+
+// add counts traffic of user to dest, it returns true when the user is
+// over quota then.
+func (a *Accounting) add(user, dest string, up, down uint64) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	s := a.userStat(user)
+	s.rollover(time.Now())
+	s.Up += up
+	s.Down += down
+	s.DayBytes += up + down
+	s.MonthBytes += up + down
+
+	if s.Dests != nil {
+		d, exist := s.Dests[dest]
+		if !exist && len(s.Dests) >= a.dests {
+			dest = _ACCOUNTING_OTHER_DESTS
+			d, exist = s.Dests[dest]
+		}
+		if !exist {
+			d = &TrafficStat{}
+			s.Dests[dest] = d
+		}
+		d.Up += up
+		d.Down += down
+	}
+
+	a.dirty = true
+	return a.overQuota(a.quota(user), s)
+}
+
+func (a *Accounting) release(user string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if s, exist := a.users[user]; exist && s.sessions > 0 {
+		s.sessions -= 1
+	}
+}
+
+// Stats returns a copy of the counters of every user.
+func (a *Accounting) Stats() map[string]*UserStat {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	stats := map[string]*UserStat{}
+	for user, s := range a.users {
+		c := *s
+		if s.Dests != nil {
+			c.Dests = map[string]*TrafficStat{}
+			for dest, d := range s.Dests {
+				t := *d
+				c.Dests[dest] = &t
+			}
+		}
+		stats[user] = &c
+	}
+	return stats
+}
+
+func (a *Accounting) save() (err error) {
+	a.lock.Lock()
+	if !a.dirty {
+		a.lock.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(a.users)
+	a.dirty = false
+	a.lock.Unlock()
+
+	// the counters added meanwhile set the flag again anyway
+	defer func() {
+		if err != nil {
+			a.lock.Lock()
+			a.dirty = true
+			a.lock.Unlock()
+		}
+	}()
+	if err != nil {
+		return
+	}
+
+	tmp := a.file + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return
+	}
+	return os.Rename(tmp, a.file)
+}
+
+func (a *Accounting) saveLoop() {
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			a.save()
+		case <-a.closeCh:
+			return
+		}
+	}
+}
+
+// Close stops the periodic save and writes the counters a last time.
+func (a *Accounting) Close() error {
+	if a.file == "" {
+		return nil
+	}
+	close(a.closeCh)
+	return a.save()
+}
+
+// Meter counts the traffic of one session, in batches.
+type Meter struct {
+	a    *Accounting
+	user string
+	dest string
+	up   uint64
+	down uint64
+
+	// counts not passed to the accounting yet
+	pendingUp   uint64
+	pendingDown uint64
+	flushed     time.Time
+
+	// called once when the user goes over quota
+	onQuota func()
+	over    bool
+
+	closed bool
+	lock   sync.Mutex
+}
+
+func (m *Meter) AddUp(n uint64) {
+	m.add(n, 0)
+}
+
+func (m *Meter) AddDown(n uint64) {
+	m.add(0, n)
+}
+
+func (m *Meter) add(up, down uint64) {
+	m.lock.Lock()
+	m.up += up
+	m.down += down
+	m.pendingUp += up
+	m.pendingDown += down
+	if m.pendingUp+m.pendingDown < _ACCOUNTING_FLUSH_BYTES &&
+		time.Since(m.flushed) < _ACCOUNTING_FLUSH_INTERVAL {
+		m.lock.Unlock()
+		return
+	}
+	m.lock.Unlock()
+
+	if m.flush() {
+		m.exceed()
+	}
+}
+
+// flush passes the pending counts to the accounting, it returns true when
+// the user is over quota.
+func (m *Meter) flush() bool {
+	m.lock.Lock()
+	up, down, dest := m.pendingUp, m.pendingDown, m.dest
+	m.pendingUp, m.pendingDown = 0, 0
+	m.flushed = time.Now()
+	m.lock.Unlock()
+
+	return up+down > 0 && m.a.add(m.user, dest, up, down)
+}
+
+func (m *Meter) exceed() {
+	m.lock.Lock()
+	first := !m.over
+	m.over = true
+	onQuota := m.onQuota
+	m.lock.Unlock()
+	if first && onQuota != nil {
+		onQuota()
+	}
+}
+
+// setDest counts the rest of the session under dest, the host sniffed
+// from a session to an ip.
+func (m *Meter) setDest(dest string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.dest = dest
+}
+
+// exceeded is true once the session was closed for the quota.
+func (m *Meter) exceeded() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.over
+}
+
+func (m *Meter) hook(dir int, n int) {
+	if dir == relay.DIR_UP {
+		m.AddUp(uint64(n))
+	} else {
+		m.AddDown(uint64(n))
+	}
+}
+
+func (m *Meter) Bytes() (up, down uint64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.up, m.down
+}
+
+func (m *Meter) Close() {
+	m.lock.Lock()
+	closed := m.closed
+	m.closed = true
+	m.lock.Unlock()
+
+	if !closed {
+		m.flush()
+		m.a.release(m.user)
+	}
+}
@@ -0,0 +1,97 @@
+package socks5
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAccountingQuotaInSession(t *testing.T) {
+	a, err := NewAccounting(&AccountingConfig{
+		Quotas: map[string]*QuotaConfig{"alice": {Daily: 100 * 1024}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := a.Open(&Request{User: "alice", Host: "example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := 0
+	m.onQuota = func() { calls += 1 }
+
+	m.AddUp(50 * 1024)
+	if calls != 0 {
+		t.Fatal("closed under quota")
+	}
+	m.AddDown(_ACCOUNTING_FLUSH_BYTES)
+	m.AddDown(_ACCOUNTING_FLUSH_BYTES)
+	if calls != 1 || !m.exceeded() {
+		t.Fatalf("onQuota called %d times", calls)
+	}
+	m.Close()
+
+	if _, err = a.Open(&Request{User: "alice"}); err != ErrQuota {
+		t.Fatalf("new session over quota: %v", err)
+	}
+}
+
+func TestAccountingBatches(t *testing.T) {
+	a, _ := NewAccounting(nil)
+	m, _ := a.Open(&Request{User: "bob", Host: "example.com"})
+
+	m.AddUp(10)
+	if s := a.Stats()["bob"]; s.Up != 0 {
+		t.Fatalf("%d bytes counted before the flush", s.Up)
+	}
+	m.Close()
+	if s := a.Stats()["bob"]; s.Up != 10 {
+		t.Fatalf("%d bytes counted after close", s.Up)
+	}
+	if up, _ := m.Bytes(); up != 10 {
+		t.Fatalf("meter counted %d bytes", up)
+	}
+}
+
+func TestAccountingDests(t *testing.T) {
+	a, _ := NewAccounting(nil)
+	a.add("bob", "a.example.com", 1, 1)
+	if s := a.Stats()["bob"]; s.Dests != nil {
+		t.Fatalf("destinations counted by default: %v", s.Dests)
+	}
+
+	a, _ = NewAccounting(&AccountingConfig{Dests: 2})
+	for _, dest := range []string{"a", "b", "c", "d", "a"} {
+		a.add("bob", dest, 1, 0)
+	}
+	dests := a.Stats()["bob"].Dests
+	if len(dests) != 3 || dests["a"].Up != 2 || dests["b"].Up != 1 ||
+		dests[_ACCOUNTING_OTHER_DESTS].Up != 2 {
+		t.Fatalf("dests: %v", dests)
+	}
+}
+
+func TestAccountingSaveError(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "acct.json")
+	a, err := NewAccounting(&AccountingConfig{File: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	// the rename onto a directory fails
+	os.Mkdir(file, 0700)
+	a.add("bob", "", 1, 1)
+	if err = a.save(); err == nil {
+		t.Fatal("save onto a directory succeeded")
+	}
+	if !a.dirty {
+		t.Fatal("failed save cleared the dirty flag")
+	}
+
+	os.Remove(file)
+	if err = a.save(); err != nil || a.dirty {
+		t.Fatalf("save: %v, dirty %v", err, a.dirty)
+	}
+}
@@ -0,0 +1,84 @@
+package socks5
+
+import (
+	"io"
+)
+
+// Once the SOCKS V5 server has started, and the client has selected the
+// Username/Password Authentication protocol, the Username/Password
+// subnegotiation begins.  This begins with the client producing a
+// Username/Password request:
+
+//         +----+------+----------+------+----------+
+//         |VER | ULEN |  UNAME   | PLEN |  PASSWD  |
+//         +----+------+----------+------+----------+
+//         | 1  |  1   | 1 to 255 |  1   | 1 to 255 |
+//         +----+------+----------+------+----------+
+
+// The server verifies the supplied UNAME and PASSWD, and sends the
+// following response:
+
+//                      +----+--------+
+//                      |VER | STATUS |
+//                      +----+--------+
+//                      | 1  |   1    |
+//                      +----+--------+
+
+// A STATUS field of X'00' indicates success. If the server returns a
+// `failure' (STATUS value other than X'00') status, it MUST close the
+// connection.
+
+const (
+	AUTH_PASSWORD_VER = 0x01
+
+	AUTH_STATUS_SUCCESS = 0x00
+	AUTH_STATUS_FAILURE = 0x01
+)
+
+var (
+	_REPLY_PASSWORD  = []byte{PROTO_VER, PROTO_METHOD_PASSWORD}
+	_REPLY_AUTH_OK   = []byte{AUTH_PASSWORD_VER, AUTH_STATUS_SUCCESS}
+	_REPLY_AUTH_FAIL = []byte{AUTH_PASSWORD_VER, AUTH_STATUS_FAILURE}
+)
+
+type Authenticator interface {
+	Authenticate(user, password string) bool
+}
+
+// StaticAuthenticator maps user names to plain text passwords.
+type StaticAuthenticator map[string]string
+
+func (a StaticAuthenticator) Authenticate(user, password string) bool {
+	if p, exist := a[user]; exist {
+		return p == password
+	}
+	return false
+}
+
+func readPasswordAuth(r io.Reader) (user, password string, err error) {
+	buf := make([]byte, 0xff, 0xff)
+	if _, err = io.ReadFull(r, buf[:2]); err != nil {
+		return
+	}
+	if buf[0] != AUTH_PASSWORD_VER {
+		err = ErrVersion
+		return
+	}
+
+	uLen := buf[1]
+	if _, err = io.ReadFull(r, buf[:uLen]); err != nil {
+		return
+	}
+	user = string(buf[:uLen])
+
+	if _, err = io.ReadFull(r, buf[:1]); err != nil {
+		return
+	}
+	pLen := buf[0]
+	if _, err = io.ReadFull(r, buf[:pLen]); err != nil {
+		return
+	}
+	password = string(buf[:pLen])
+
+	return
+}
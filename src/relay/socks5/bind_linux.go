@@ -0,0 +1,20 @@
+//go:build linux
+// +build linux
+
+package socks5
+
+import "syscall"
+
+func bindToDeviceControl(iface string) (
+	func(network, address string, c syscall.RawConn) error, error) {
+	return func(network, address string, c syscall.RawConn) (err error) {
+		e := c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET,
+				syscall.SO_BINDTODEVICE, iface)
+		})
+		if e != nil {
+			return e
+		}
+		return
+	}, nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package socks5
+
+import "syscall"
+
+func bindToDeviceControl(iface string) (
+	func(network, address string, c syscall.RawConn) error, error) {
+	return nil, ErrBindDevice
+}
@@ -0,0 +1,178 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Client dials destinations through an upstream socks5 server.
+type Client struct {
+	Addr     string
+	User     string
+	Password string
+
+	// connect to the upstream server with a net.Dialer when nil
+	Dialer Dialer
+
+	// talk to the upstream server over tls when not nil, the server name
+	// defaults to the host of Addr
+	TLS *tls.Config
+}
+
+func (c *Client) Dial(network, addr string) (net.Conn, error) {
+	return c.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to addr through the upstream server, the deadline of
+// ctx covers both the connection and the socks5 handshake.
+func (c *Client) DialContext(ctx context.Context, network, addr string) (
+	conn net.Conn, err error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return
+	}
+
+	if conn, err = c.connect(ctx, network); err != nil {
+		return
+	}
+	if _, err = c.handshake(conn, CMD_CONNECT, host, uint16(port)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return
+}
+
+// Resolve asks the upstream server for an address of host with the tor
+// RESOLVE extension.
+func (c *Client) Resolve(ctx context.Context, host string) (
+	ip net.IP, err error) {
+	conn, err := c.connect(ctx, "tcp")
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	bnd, err := c.handshake(conn, CMD_RESOLVE, host, 0)
+	if err != nil {
+		return
+	}
+	if ip = net.ParseIP(bnd); ip == nil {
+		err = ErrUnknownAddrType
+	}
+	return
+}
+
+// ResolvePTR asks the upstream server for the name of ip with the tor
+// RESOLVE_PTR extension.
+func (c *Client) ResolvePTR(ctx context.Context, ip net.IP) (
+	name string, err error) {
+	conn, err := c.connect(ctx, "tcp")
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	return c.handshake(conn, CMD_RESOLVE_PTR, ip.String(), 0)
+}
+
+func (c *Client) connect(ctx context.Context, network string) (
+	conn net.Conn, err error) {
+	var d Dialer = c.Dialer
+	if d == nil {
+		d = &net.Dialer{}
+	}
+	if conn, err = d.DialContext(ctx, network, c.Addr); err != nil {
+		return
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if c.TLS != nil {
+		conf := c.TLS
+		if conf.ServerName == "" {
+			conf = conf.Clone()
+			conf.ServerName, _, _ = net.SplitHostPort(c.Addr)
+		}
+		tc := tls.Client(conn, conf)
+		if err = tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+	return
+}
+
+// handshake sends a cmd request and returns the address in the reply.
+func (c *Client) handshake(conn net.Conn, cmd byte, host string,
+	port uint16) (bnd string, err error) {
+	buf := make([]byte, 0xff, 0xff)
+
+	method := byte(PROTO_METHOD_NOAUTH)
+	if c.User != "" {
+		method = PROTO_METHOD_PASSWORD
+	}
+	if _, err = conn.Write([]byte{PROTO_VER, 1, method}); err != nil {
+		return
+	}
+	if _, err = io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+	if buf[0] != PROTO_VER {
+		return "", ErrVersion
+	} else if buf[1] != method {
+		return "", ErrMethodNotAcceptable
+	}
+
+	if method == PROTO_METHOD_PASSWORD {
+		auth := new(bytes.Buffer)
+		auth.Write([]byte{AUTH_PASSWORD_VER, byte(len(c.User))})
+		auth.WriteString(c.User)
+		auth.WriteByte(byte(len(c.Password)))
+		auth.WriteString(c.Password)
+		if _, err = conn.Write(auth.Bytes()); err != nil {
+			return
+		}
+		if _, err = io.ReadFull(conn, buf[:2]); err != nil {
+			return
+		}
+		if buf[1] != AUTH_STATUS_SUCCESS {
+			return "", ErrAuthFailed
+		}
+	}
+
+	req := new(bytes.Buffer)
+	req.Write([]byte{PROTO_VER, cmd, 0x00})
+	if err = writeAddr(req, host, port); err != nil {
+		return
+	}
+	if _, err = conn.Write(req.Bytes()); err != nil {
+		return
+	}
+
+	if _, err = io.ReadFull(conn, buf[:4]); err != nil {
+		return
+	}
+	if buf[0] != PROTO_VER {
+		return "", ErrVersion
+	}
+	rep, atyp := buf[1], buf[3]
+	if bnd, _, err = readAddr(conn, atyp); err != nil {
+		return
+	}
+	if rep != REP_SUCCESS {
+		return "", &ReplyError{rep}
+	}
+	return
+}
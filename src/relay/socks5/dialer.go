@@ -0,0 +1,125 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+)
+
+var _DEFAULT_ATTEMPT_DELAY = 250 * time.Millisecond
+
+// NewBindDialer returns a dialer whose connections leave from localAddr,
+// an ip, and/or the network interface iface.
+func NewBindDialer(localAddr, iface string) (d *net.Dialer, err error) {
+	d = &net.Dialer{}
+	if localAddr != "" {
+		ip := net.ParseIP(localAddr)
+		if ip == nil {
+			return nil, ErrBindAddr
+		}
+		d.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	if iface != "" {
+		if d.Control, err = bindToDeviceControl(iface); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// interleaveIPs orders ips alternating the address families, starting with
+// prefer, "ipv4" or "ipv6", or with the family of the first ip.
+func interleaveIPs(ips []net.IP, prefer string) []net.IP {
+	if len(ips) == 0 {
+		return ips
+	}
+
+	v4, v6 := []net.IP{}, []net.IP{}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	first, second := v4, v6
+	if prefer == RESOLVER_PREFER_IPV6 ||
+		(prefer != RESOLVER_PREFER_IPV4 && ips[0].To4() == nil) {
+		first, second = v6, v4
+	}
+
+	res := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			res = append(res, first[i])
+		}
+		if i < len(second) {
+			res = append(res, second[i])
+		}
+	}
+	return res
+}
+
+// dialHappyEyeballs races connection attempts to ips as RFC 8305 does, an
+// attempt starts when the previous one fails or after delay, the first
+// established connection wins and the others are closed.
+func dialHappyEyeballs(ctx context.Context, d Dialer, ips []net.IP,
+	port uint16, delay time.Duration) (conn net.Conn, ip net.IP, err error) {
+	if len(ips) == 0 {
+		return nil, nil, ErrDNSNotFound
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		ip   net.IP
+		err  error
+	}
+	results := make(chan *result, len(ips))
+	next, pending := 0, 0
+	var delayCh <-chan time.Time
+
+	start := func() {
+		ip := ips[next]
+		next, pending = next+1, pending+1
+		go func() {
+			c, e := d.DialContext(ctx, "tcp",
+				net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
+			results <- &result{c, ip, e}
+		}()
+		if next < len(ips) {
+			delayCh = time.After(delay)
+		} else {
+			delayCh = nil
+		}
+	}
+
+	start()
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending -= 1
+			if r.err == nil {
+				go func(n int) {
+					for i := 0; i < n; i++ {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, r.ip, nil
+			}
+			err = r.err
+			if next < len(ips) {
+				start()
+			}
+		case <-delayCh:
+			start()
+		}
+	}
+	return nil, nil, err
+}
@@ -0,0 +1,269 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+// A minimal DNS stub client, RFC 1035, enough to ask an upstream server
+// for A, AAAA and PTR records.
+
+const (
+	DNS_TYPE_A    = 1
+	DNS_TYPE_PTR  = 12
+	DNS_TYPE_AAAA = 28
+
+	DNS_CLASS_IN = 1
+
+	DNS_RCODE_SUCCESS  = 0
+	DNS_RCODE_NXDOMAIN = 3
+
+	_DNS_FLAG_QR = 0x8000
+	_DNS_FLAG_TC = 0x0200
+	_DNS_FLAG_RD = 0x0100
+
+	_DNS_HEADER_LEN  = 12
+	_DNS_UDP_MSG_LEN = 4096
+)
+
+var (
+	ErrDNSFormat   = errors.New("socks5: dns message format error")
+	ErrDNSNotFound = errors.New("socks5: dns name not found")
+	ErrDNSServer   = errors.New("socks5: dns server failure")
+
+	// the answer is not about the question asked
+	ErrDNSQuestion = errors.New("socks5: dns answer to another question")
+)
+
+type dnsRecord struct {
+	typ  uint16
+	ttl  uint32
+	data []byte
+
+	// the decoded domain name of a PTR record
+	name string
+}
+
+func buildDNSQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, []uint16{
+		id, _DNS_FLAG_RD, 1, 0, 0, 0})
+
+	name = strings.TrimSuffix(name, ".")
+	if len(name) > 253 {
+		return nil, ErrDNSFormat
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, ErrDNSFormat
+		}
+		buf.WriteByte(byte(len(label)))
+		buf.WriteString(label)
+	}
+	buf.WriteByte(0)
+	binary.Write(buf, binary.BigEndian, []uint16{qtype, DNS_CLASS_IN})
+	return buf.Bytes(), nil
+}
+
+// reverseName returns the name under in-addr.arpa or ip6.arpa to ask for
+// the PTR record of ip.
+func reverseName(ip net.IP) string {
+	buf := new(bytes.Buffer)
+	if ipv4 := ip.To4(); ipv4 != nil {
+		for i := len(ipv4) - 1; i >= 0; i-- {
+			fmt.Fprintf(buf, "%d.", ipv4[i])
+		}
+		buf.WriteString("in-addr.arpa")
+	} else {
+		ip = ip.To16()
+		for i := len(ip) - 1; i >= 0; i-- {
+			fmt.Fprintf(buf, "%x.%x.", ip[i]&0x0f, ip[i]>>4)
+		}
+		buf.WriteString("ip6.arpa")
+	}
+	return buf.String()
+}
+
+// readDNSName decodes a possibly compressed name starting at off, and
+// returns the name and the offset right after it.
+func readDNSName(msg []byte, off int) (name string, next int, err error) {
+	labels := []string{}
+	next = -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, ErrDNSFormat
+		}
+		l := int(msg[off])
+		switch l & 0xc0 {
+		case 0x00:
+			if l == 0 {
+				if next < 0 {
+					next = off + 1
+				}
+				return strings.Join(labels, "."), next, nil
+			}
+			if off+1+l > len(msg) {
+				return "", 0, ErrDNSFormat
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		case 0xc0:
+			if off+2 > len(msg) {
+				return "", 0, ErrDNSFormat
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			if jumps += 1; jumps > 16 {
+				return "", 0, ErrDNSFormat
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+		default:
+			return "", 0, ErrDNSFormat
+		}
+	}
+}
+
+// parseDNSResponse returns the records of the answer to the question of
+// name and qtype, sent with id.
+func parseDNSResponse(msg []byte, id uint16, name string, qtype uint16) (
+	records []*dnsRecord, truncated bool, err error) {
+	if len(msg) < _DNS_HEADER_LEN {
+		return nil, false, ErrDNSFormat
+	}
+
+	var h [6]uint16
+	for i := range h {
+		h[i] = binary.BigEndian.Uint16(msg[i*2:])
+	}
+	if h[0] != id || h[1]&_DNS_FLAG_QR == 0 {
+		return nil, false, ErrDNSFormat
+	}
+	if h[1]&_DNS_FLAG_TC != 0 {
+		return nil, true, nil
+	}
+
+	// the answer echoes the single question
+	if h[2] != 1 {
+		return nil, false, ErrDNSQuestion
+	}
+	qname, off, err := readDNSName(msg, _DNS_HEADER_LEN)
+	if err != nil {
+		return
+	}
+	if off+4 > len(msg) {
+		return nil, false, ErrDNSFormat
+	}
+	if !strings.EqualFold(qname, strings.TrimSuffix(name, ".")) ||
+		binary.BigEndian.Uint16(msg[off:]) != qtype ||
+		binary.BigEndian.Uint16(msg[off+2:]) != DNS_CLASS_IN {
+		return nil, false, ErrDNSQuestion
+	}
+	off += 4
+
+	switch h[1] & 0x000f {
+	case DNS_RCODE_SUCCESS:
+	case DNS_RCODE_NXDOMAIN:
+		return nil, false, ErrDNSNotFound
+	default:
+		return nil, false, ErrDNSServer
+	}
+
+	for i := uint16(0); i < h[3]; i++ {
+		if _, off, err = readDNSName(msg, off); err != nil {
+			return
+		}
+		if off+10 > len(msg) {
+			return nil, false, ErrDNSFormat
+		}
+		r := &dnsRecord{
+			typ: binary.BigEndian.Uint16(msg[off:]),
+			ttl: binary.BigEndian.Uint32(msg[off+4:]),
+		}
+		rdLen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdLen > len(msg) {
+			return nil, false, ErrDNSFormat
+		}
+		r.data = msg[off : off+rdLen]
+		if r.typ == DNS_TYPE_PTR {
+			if r.name, _, err = readDNSName(msg, off); err != nil {
+				return
+			}
+		}
+		off += rdLen
+		records = append(records, r)
+	}
+
+	return
+}
+
+// dnsExchange sends a single question to server over network, "udp" or
+// "tcp", a truncated udp answer is retried over tcp.
+func dnsExchange(network, server, name string, qtype uint16,
+	timeout time.Duration) (records []*dnsRecord, err error) {
+	id := uint16(rand.Uint32())
+	query, err := buildDNSQuery(id, name, qtype)
+	if err != nil {
+		return
+	}
+
+	conn, err := net.DialTimeout(network, server, timeout)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	var truncated bool
+	if network == "tcp" {
+		buf := new(bytes.Buffer)
+		binary.Write(buf, binary.BigEndian, uint16(len(query)))
+		buf.Write(query)
+		if _, err = conn.Write(buf.Bytes()); err != nil {
+			return
+		}
+
+		var l uint16
+		if err = binary.Read(conn, binary.BigEndian, &l); err != nil {
+			return
+		}
+		msg := make([]byte, l)
+		if _, err = io.ReadFull(conn, msg); err != nil {
+			return
+		}
+		records, _, err = parseDNSResponse(msg, id, name, qtype)
+		return
+	}
+
+	if _, err = conn.Write(query); err != nil {
+		return
+	}
+	msg := make([]byte, _DNS_UDP_MSG_LEN)
+	for {
+		var n int
+		if n, err = conn.Read(msg); err != nil {
+			return
+		}
+		// ignore stray answers of other queries
+		if n < 2 || binary.BigEndian.Uint16(msg) != id {
+			continue
+		}
+		records, truncated, err = parseDNSResponse(msg[:n], id, name, qtype)
+		if err != ErrDNSQuestion {
+			break
+		}
+	}
+
+	if err == nil && truncated {
+		return dnsExchange("tcp", server, name, qtype, timeout)
+	}
+	return
+}
@@ -1,10 +1,36 @@
 package socks5
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
 	ErrVersion             = errors.New("socks5: version error")
 	ErrMethodNotAcceptable = errors.New("socks5: methods not acceptable")
 	ErrUnknownAddrType     = errors.New("socks5: unknown address type")
 	ErrUnknownCommand      = errors.New("socks5: unknown command")
+	ErrAuthFailed          = errors.New("socks5: authentication failed")
+	ErrRejected            = errors.New("socks5: connection not allowed")
+	ErrUnknownOutbound     = errors.New("socks5: unknown outbound")
+	ErrQuota               = errors.New("socks5: user over quota")
+	ErrConnRate            = errors.New("socks5: connection rate exceeded")
+	ErrSessionClosed       = errors.New("socks5: session closed")
+	ErrServerClosed        = errors.New("socks5: server closed")
+	ErrBindAddr            = errors.New("socks5: invalid bind address")
+	ErrBindDevice          = errors.New("socks5: bind to device not supported")
+	ErrTransparent         = errors.New("socks5: transparent proxy not supported")
+	ErrNoOriginalDst       = errors.New("socks5: no original destination")
+	ErrTLSConfig           = errors.New("socks5: invalid tls config")
+	ErrResolverConfig      = errors.New("socks5: invalid resolver config")
 )
+
+// ReplyError is returned by Client when the upstream server answers with
+// a REP other than REP_SUCCESS.
+type ReplyError struct {
+	Rep byte
+}
+
+func (e *ReplyError) Error() string {
+	return fmt.Sprintf("socks5: server reply 0x%02x", e.Rep)
+}
@@ -0,0 +1,118 @@
+package socks5
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/solomonwzs/goxutil/logger"
+)
+
+var (
+	_DEFAULT_HANDSHAKE_TIMEOUT = 10 * time.Second
+	_DEFAULT_DIAL_TIMEOUT      = 10 * time.Second
+	_DEFAULT_KEEPALIVE         = 30 * time.Second
+)
+
+// Dialer opens the connections of direct outbounds, *net.Dialer is one.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+type Logger interface {
+	Error(v ...interface{})
+	Info(v ...interface{})
+}
+
+type defaultLogger struct{}
+
+func (defaultLogger) Error(v ...interface{}) { logger.Error(v...) }
+func (defaultLogger) Info(v ...interface{})  { logger.Info(v...) }
+
+type Options struct {
+	// require username/password authentication when not nil
+	Auth Authenticator
+
+	// resolve domain names with DefaultResolver when nil
+	Resolver Resolver
+
+	// dial direct outbounds with a net.Dialer when nil
+	Dialer Dialer
+
+	// route every request to the default direct outbound when nil, the
+	// reject rules of the router are the acl
+	Router *Router
+
+	// count traffic and enforce quotas when not nil
+	Accounting *Accounting
+
+	// shape traffic and limit new connections when not nil
+	RateLimiter *RateLimiter
+
+	// log with the goxutil logger when nil
+	Logger Logger
+
+	// record every ended session when not nil
+	AccessLog AccessLogger
+
+	// greeting, authentication and request must complete within
+	// HandshakeTimeout, the outbound connection within DialTimeout,
+	// zero uses the defaults
+	HandshakeTimeout time.Duration
+	DialTimeout      time.Duration
+
+	// close a session without traffic in both directions for IdleTimeout,
+	// zero never closes idle sessions
+	IdleTimeout time.Duration
+
+	// tcp keepalive period of both connections, zero uses the default,
+	// negative disables keepalive
+	KeepAlive time.Duration
+
+	// on CONNECT to an ip, reply at once and wait up to SniffTimeout for
+	// the TLS SNI or HTTP Host the client sends, which then feeds the
+	// domain rules and the access log. The client sees the success reply
+	// before the dial, a rejected or failed dial just closes its connection
+	Sniff        bool
+	SniffTimeout time.Duration
+
+	// TRANSPARENT_REDIRECT or TRANSPARENT_TPROXY to take connections
+	// diverted by iptables instead of socks clients, the original
+	// destination goes through the same routing as a CONNECT
+	Transparent string
+
+	// wrap the client connections in tls when not nil, see
+	// TLSConfig.ServerConfig
+	TLS *tls.Config
+}
+
+// withDefaults returns a copy of opt with the unset fields filled.
+func (opt *Options) withDefaults() *Options {
+	o := Options{}
+	if opt != nil {
+		o = *opt
+	}
+	if o.Resolver == nil {
+		o.Resolver = DefaultResolver
+	}
+	if o.Router == nil {
+		o.Router, _ = NewRouter(nil, o.Resolver, o.Dialer)
+	}
+	if o.Logger == nil {
+		o.Logger = defaultLogger{}
+	}
+	if o.HandshakeTimeout == 0 {
+		o.HandshakeTimeout = _DEFAULT_HANDSHAKE_TIMEOUT
+	}
+	if o.DialTimeout == 0 {
+		o.DialTimeout = _DEFAULT_DIAL_TIMEOUT
+	}
+	if o.KeepAlive == 0 {
+		o.KeepAlive = _DEFAULT_KEEPALIVE
+	}
+	if o.SniffTimeout == 0 {
+		o.SniffTimeout = _DEFAULT_SNIFF_TIMEOUT
+	}
+	return &o
+}
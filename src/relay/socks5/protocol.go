@@ -78,6 +78,10 @@ const (
 	CMD_BIND          = 0x02
 	CMD_UDP_ASSOCIATE = 0x03
 
+	// tor extensions, the reply carries the address or the name
+	CMD_RESOLVE     = 0xf0
+	CMD_RESOLVE_PTR = 0xf1
+
 	ATYP_IPV4       = 0x01
 	ATYP_DOMAINNAME = 0x03
 	ATYP_IPV6       = 0x04
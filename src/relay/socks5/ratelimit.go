@@ -0,0 +1,261 @@
+package socks5
+
+import (
+	"net"
+	"relay"
+	"sync"
+	"time"
+)
+
+var _RATE_LIMIT_IDLE = 60 * time.Second
+
+// TokenBucket is refilled with rate tokens per second, up to burst tokens,
+// a zero rate never limits.
+type TokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	lock   *sync.Mutex
+}
+
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	b := &TokenBucket{lock: &sync.Mutex{}, last: time.Now()}
+	b.SetRate(rate, burst)
+	b.tokens = b.burst
+	return b
+}
+
+// SetRate changes the rate at runtime, burst defaults to one second of
+// tokens.
+func (b *TokenBucket) SetRate(rate float64, burst int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refill(time.Now())
+	b.rate, b.burst = rate, float64(burst)
+	if b.burst <= 0 {
+		b.burst = rate
+	}
+	if b.burst < 1 {
+		b.burst = 1
+	}
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+func (b *TokenBucket) refill(now time.Time) {
+	if d := now.Sub(b.last); d > 0 {
+		b.tokens += d.Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+// Allow takes one token without waiting.
+func (b *TokenBucket) Allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.rate <= 0 {
+		return true
+	}
+	b.refill(time.Now())
+	if b.tokens >= 1 {
+		b.tokens -= 1
+		return true
+	}
+	return false
+}
+
+// Wait takes n tokens, sleeping until the bucket has paid them back.
+func (b *TokenBucket) Wait(n int) {
+	b.lock.Lock()
+	if b.rate <= 0 {
+		b.lock.Unlock()
+		return
+	}
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	var d time.Duration
+	if b.tokens < 0 {
+		d = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.lock.Unlock()
+
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+func (b *TokenBucket) idle(now time.Time) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return now.Sub(b.last) > _RATE_LIMIT_IDLE
+}
+
+type RateLimitConfig struct {
+	// bytes per second of both directions, 0 means unlimited
+	Conn     uint64 `json:"conn,omitempty"`
+	Listener uint64 `json:"listener,omitempty"`
+
+	// new connections per second of one client ip, 0 means unlimited
+	ConnPerIP float64 `json:"conn_per_ip,omitempty"`
+	ConnBurst int     `json:"conn_burst,omitempty"`
+}
+
+// UserRates holds the bucket of every user, shared by the limiters of all
+// listeners like the global bucket.
+type UserRates struct {
+	rate    float64
+	buckets map[string]*TokenBucket
+	lock    *sync.Mutex
+}
+
+// NewUserRates limits every user to rate bytes per second, 0 means
+// unlimited.
+func NewUserRates(rate uint64) *UserRates {
+	return &UserRates{
+		rate:    float64(rate),
+		buckets: map[string]*TokenBucket{},
+		lock:    &sync.Mutex{},
+	}
+}
+
+// SetRate changes the rate of every user at runtime.
+func (u *UserRates) SetRate(rate uint64) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	u.rate = float64(rate)
+	for _, b := range u.buckets {
+		b.SetRate(u.rate, 0)
+	}
+}
+
+func (u *UserRates) bucket(user string) *TokenBucket {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	b, exist := u.buckets[user]
+	if !exist {
+		b = NewTokenBucket(u.rate, 0)
+		u.buckets[user] = b
+	}
+	return b
+}
+
+// RateLimiter shapes the traffic of the sessions of one listener, each
+// byte is charged to the connection, the user, the listener and the
+// global bucket.
+type RateLimiter struct {
+	conf     RateLimitConfig
+	global   *TokenBucket
+	users    *UserRates
+	listener *TokenBucket
+	conns    map[*TokenBucket]struct{}
+	ips      map[string]*TokenBucket
+	swept    time.Time
+	lock     *sync.Mutex
+}
+
+// NewRateLimiter creates the limiter of a listener, global and users are
+// shared by all listeners and may be nil.
+func NewRateLimiter(conf *RateLimitConfig, global *TokenBucket,
+	users *UserRates) *RateLimiter {
+	l := &RateLimiter{
+		global:   global,
+		users:    users,
+		listener: NewTokenBucket(0, 0),
+		conns:    map[*TokenBucket]struct{}{},
+		ips:      map[string]*TokenBucket{},
+		swept:    time.Now(),
+		lock:     &sync.Mutex{},
+	}
+	l.SetConfig(conf)
+	return l
+}
+
+// SetConfig changes the rates at runtime, established sessions follow the
+// new rates too.
+func (l *RateLimiter) SetConfig(conf *RateLimitConfig) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if conf == nil {
+		conf = &RateLimitConfig{}
+	}
+	l.conf = *conf
+	l.listener.SetRate(float64(conf.Listener), 0)
+	for b := range l.conns {
+		b.SetRate(float64(conf.Conn), 0)
+	}
+	for _, b := range l.ips {
+		b.SetRate(conf.ConnPerIP, conf.ConnBurst)
+	}
+}
+
+// AllowConn charges a new connection to the client ip.
+func (l *RateLimiter) AllowConn(addr net.Addr) bool {
+	host := addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	l.lock.Lock()
+	if l.conf.ConnPerIP <= 0 {
+		l.lock.Unlock()
+		return true
+	}
+	// idle ips are forgotten once per idle period
+	if now := time.Now(); now.Sub(l.swept) > _RATE_LIMIT_IDLE {
+		for ip, b := range l.ips {
+			if b.idle(now) {
+				delete(l.ips, ip)
+			}
+		}
+		l.swept = now
+	}
+	b, exist := l.ips[host]
+	if !exist {
+		b = NewTokenBucket(l.conf.ConnPerIP, l.conf.ConnBurst)
+		l.ips[host] = b
+	}
+	l.lock.Unlock()
+
+	return b.Allow()
+}
+
+// hook returns the relay hook of a new session of user, which charges the
+// session, user, listener and global buckets, and the function to call
+// when the session ends.
+func (l *RateLimiter) hook(user string) (relay.Hook, func()) {
+	conn := NewTokenBucket(0, 0)
+	l.lock.Lock()
+	conn.SetRate(float64(l.conf.Conn), 0)
+	l.conns[conn] = struct{}{}
+	l.lock.Unlock()
+
+	buckets := []*TokenBucket{conn, l.listener}
+	if l.users != nil {
+		buckets = append(buckets, l.users.bucket(user))
+	}
+	if l.global != nil {
+		buckets = append(buckets, l.global)
+	}
+
+	hook := func(dir int, n int) {
+		for _, b := range buckets {
+			b.Wait(n)
+		}
+	}
+	done := func() {
+		l.lock.Lock()
+		delete(l.conns, conn)
+		l.lock.Unlock()
+	}
+	return hook, done
+}
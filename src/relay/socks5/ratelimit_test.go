@@ -0,0 +1,66 @@
+package socks5
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterUsersShared(t *testing.T) {
+	users := NewUserRates(1000)
+	a := NewRateLimiter(nil, nil, users)
+	b := NewRateLimiter(nil, nil, users)
+
+	_, doneA := a.hook("alice")
+	defer doneA()
+	_, doneB := b.hook("alice")
+	defer doneB()
+	if len(users.buckets) != 1 {
+		t.Fatalf("%d buckets of one user", len(users.buckets))
+	}
+
+	users.SetRate(2000)
+	if r := users.bucket("alice").rate; r != 2000 {
+		t.Fatalf("user rate %v after SetRate", r)
+	}
+}
+
+func TestRateLimiterLiveConns(t *testing.T) {
+	l := NewRateLimiter(&RateLimitConfig{Conn: 1000}, nil, nil)
+	_, done := l.hook("")
+	if len(l.conns) != 1 {
+		t.Fatalf("%d live connections", len(l.conns))
+	}
+
+	l.SetConfig(&RateLimitConfig{Conn: 5000})
+	for b := range l.conns {
+		if b.rate != 5000 {
+			t.Fatalf("live connection rate %v after SetConfig", b.rate)
+		}
+	}
+
+	done()
+	if len(l.conns) != 0 {
+		t.Fatalf("%d live connections after the end", len(l.conns))
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	l := NewRateLimiter(&RateLimitConfig{ConnPerIP: 1000}, nil, nil)
+	l.AllowConn(&net.TCPAddr{IP: net.IPv4(10, 0, 0, 1)})
+	l.AllowConn(&net.TCPAddr{IP: net.IPv4(10, 0, 0, 2)})
+	if len(l.ips) != 2 {
+		t.Fatalf("%d ips tracked", len(l.ips))
+	}
+
+	// the refilled buckets are idle once a period went by
+	past := time.Now().Add(-2 * _RATE_LIMIT_IDLE)
+	l.swept = past
+	for _, b := range l.ips {
+		b.last = past
+	}
+	l.AllowConn(&net.TCPAddr{IP: net.IPv4(10, 0, 0, 3)})
+	if len(l.ips) != 1 {
+		t.Fatalf("%d ips tracked after the sweep", len(l.ips))
+	}
+}
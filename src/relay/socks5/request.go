@@ -0,0 +1,113 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+)
+
+// Request describes the destination asked by a client, together with the
+// session information the routing rules may look at.
+type Request struct {
+	Command    byte
+	Host       string // domain name or literal ip
+	Port       uint16
+	IP         net.IP // nil until the domain name is resolved
+	User       string
+	ClientAddr net.Addr
+
+	// the host name found in the first bytes of a session to an ip, see
+	// Options.Sniff
+	SniffedHost string
+}
+
+func (req *Request) Addr() string {
+	return net.JoinHostPort(req.Host, strconv.Itoa(int(req.Port)))
+}
+
+func (req *Request) IsDomain() bool {
+	return net.ParseIP(req.Host) == nil
+}
+
+// Domain returns the requested domain name, or the sniffed one when an ip
+// was requested.
+func (req *Request) Domain() string {
+	if req.IsDomain() {
+		return req.Host
+	}
+	return req.SniffedHost
+}
+
+func readAddr(r io.Reader, atyp byte) (host string, port uint16, err error) {
+	buf := make([]byte, 0xff, 0xff)
+
+	switch atyp {
+	case ATYP_IPV4:
+		if _, err = io.ReadFull(r, buf[:4]); err != nil {
+			return
+		}
+		host = net.IP(buf[:4]).String()
+	case ATYP_DOMAINNAME:
+		if _, err = io.ReadFull(r, buf[:1]); err != nil {
+			return
+		}
+		domainLen := buf[0]
+
+		if _, err = io.ReadFull(r, buf[:domainLen]); err != nil {
+			return
+		}
+		host = string(buf[:domainLen])
+	case ATYP_IPV6:
+		if _, err = io.ReadFull(r, buf[:16]); err != nil {
+			return
+		}
+		host = net.IP(buf[:16]).String()
+	default:
+		err = ErrUnknownAddrType
+		return
+	}
+
+	if _, err = io.ReadFull(r, buf[:2]); err != nil {
+		return
+	}
+	port = binary.BigEndian.Uint16(buf[:2])
+	return
+}
+
+func writeAddr(buf *bytes.Buffer, host string, port uint16) error {
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) == 0 || len(host) > 0xff {
+			return ErrUnknownAddrType
+		}
+		buf.WriteByte(ATYP_DOMAINNAME)
+		buf.WriteByte(byte(len(host)))
+		buf.WriteString(host)
+	} else if ipv4 := ip.To4(); ipv4 != nil {
+		buf.WriteByte(ATYP_IPV4)
+		buf.Write(ipv4)
+	} else {
+		buf.WriteByte(ATYP_IPV6)
+		buf.Write(ip.To16())
+	}
+	binary.Write(buf, binary.BigEndian, port)
+	return nil
+}
+
+func newReply(rep byte, addr net.Addr) []byte {
+	host, port := "0.0.0.0", uint16(0)
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok && tcpAddr.IP != nil {
+		host, port = tcpAddr.IP.String(), uint16(tcpAddr.Port)
+	}
+	return newHostReply(rep, host, port)
+}
+
+func newHostReply(rep byte, host string, port uint16) []byte {
+	buf := new(bytes.Buffer)
+	buf.Write([]byte{PROTO_VER, rep, 0x00})
+	if writeAddr(buf, host, port) != nil {
+		writeAddr(buf, "0.0.0.0", port)
+	}
+	return buf.Bytes()
+}
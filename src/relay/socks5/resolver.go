@@ -0,0 +1,369 @@
+package socks5
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RESOLVER_PREFER_IPV4 = "ipv4"
+	RESOLVER_PREFER_IPV6 = "ipv6"
+	RESOLVER_IPV4_ONLY   = "ipv4_only"
+	RESOLVER_IPV6_ONLY   = "ipv6_only"
+)
+
+var (
+	// ttl of answers of the system resolver, which does not report one
+	_RESOLVER_SYSTEM_TTL   = 60 * time.Second
+	_RESOLVER_NEGATIVE_TTL = 10 * time.Second
+	_RESOLVER_TIMEOUT      = 4 * time.Second
+
+	// max entries of the cache
+	_RESOLVER_CACHE_SIZE = 4096
+)
+
+// DefaultResolver is used by routers and handlers created without one.
+var DefaultResolver Resolver = newCacheResolver(&ResolverConfig{})
+
+type Resolver interface {
+	LookupIP(host string) ([]net.IP, error)
+	LookupAddr(ip net.IP) ([]string, error)
+}
+
+type ResolverConfig struct {
+	// upstream dns server, "8.8.8.8:53", use the system resolver when empty
+	Server string `json:"server,omitempty"`
+
+	// "udp" or "tcp", default "udp"
+	Network string `json:"network,omitempty"`
+
+	// static overrides, answered before the cache and the upstream
+	Hosts map[string][]string `json:"hosts,omitempty"`
+
+	// "ipv4", "ipv6", "ipv4_only" or "ipv6_only", default "ipv4"
+	Prefer string `json:"prefer,omitempty"`
+
+	// upstream query timeout in milliseconds
+	Timeout int `json:"timeout,omitempty"`
+}
+
+type resolverCacheEntry struct {
+	ips    []net.IP
+	names  []string
+	err    error
+	expire time.Time
+}
+
+// CacheResolver answers from static hosts, then from an in-memory cache
+// whose entries live as long as the record ttl, and queries the upstream
+// server on misses.
+type CacheResolver struct {
+	server  string
+	network string
+	prefer  string
+	timeout time.Duration
+	hosts   map[string][]net.IP
+
+	cache     map[string]*resolverCacheEntry
+	cacheLock *sync.Mutex
+}
+
+// validPrefer accepts the address family preferences, "" is the default.
+func validPrefer(prefer string) bool {
+	switch prefer {
+	case "", RESOLVER_PREFER_IPV4, RESOLVER_PREFER_IPV6, RESOLVER_IPV4_ONLY,
+		RESOLVER_IPV6_ONLY:
+		return true
+	}
+	return false
+}
+
+func NewResolver(conf *ResolverConfig) (*CacheResolver, error) {
+	if conf == nil {
+		conf = &ResolverConfig{}
+	}
+	if !validPrefer(conf.Prefer) || (conf.Network != "" &&
+		conf.Network != "udp" && conf.Network != "tcp") ||
+		conf.Timeout < 0 {
+		return nil, ErrResolverConfig
+	}
+	for _, addrs := range conf.Hosts {
+		for _, a := range addrs {
+			if net.ParseIP(a) == nil {
+				return nil, ErrResolverConfig
+			}
+		}
+	}
+	return newCacheResolver(conf), nil
+}
+
+func newCacheResolver(conf *ResolverConfig) *CacheResolver {
+	r := &CacheResolver{
+		server:  conf.Server,
+		network: conf.Network,
+		prefer:  conf.Prefer,
+		timeout: time.Duration(conf.Timeout) * time.Millisecond,
+		hosts:   map[string][]net.IP{},
+
+		cache:     map[string]*resolverCacheEntry{},
+		cacheLock: &sync.Mutex{},
+	}
+	if r.network == "" {
+		r.network = "udp"
+	}
+	if r.timeout == 0 {
+		r.timeout = _RESOLVER_TIMEOUT
+	}
+	for host, addrs := range conf.Hosts {
+		for _, a := range addrs {
+			if ip := net.ParseIP(a); ip != nil {
+				name := canonicalHost(host)
+				r.hosts[name] = append(r.hosts[name], ip)
+			}
+		}
+	}
+
+	return r
+}
+
+func canonicalHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+func (r *CacheResolver) LookupIP(host string) (ips []net.IP, err error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	host = canonicalHost(host)
+	if ips, exist := r.hosts[host]; exist {
+		if ips = r.sortIPs(ips); len(ips) == 0 {
+			return nil, ErrDNSNotFound
+		}
+		return ips, nil
+	}
+
+	now := time.Now()
+	r.cacheLock.Lock()
+	e, exist := r.cache[host]
+	r.cacheLock.Unlock()
+	if exist && now.Before(e.expire) {
+		return e.ips, e.err
+	}
+
+	var ttl time.Duration
+	if r.server == "" {
+		ips, ttl, err = r.lookupSystem(host)
+	} else {
+		ips, ttl, err = r.lookupServer(host)
+	}
+	if ips = r.sortIPs(ips); err == nil && len(ips) == 0 {
+		err = ErrDNSNotFound
+	}
+	if err == ErrDNSNotFound {
+		ips, ttl = nil, _RESOLVER_NEGATIVE_TTL
+	} else if err != nil {
+		return
+	}
+
+	if ttl > 0 {
+		r.store(host, &resolverCacheEntry{
+			ips:    ips,
+			err:    err,
+			expire: now.Add(ttl),
+		})
+	}
+	return
+}
+
+func (r *CacheResolver) lookupSystem(host string) (
+	ips []net.IP, ttl time.Duration, err error) {
+	addrs, err := net.LookupIP(host)
+	if err != nil {
+		if e, ok := err.(*net.DNSError); ok && e.IsNotFound {
+			err = ErrDNSNotFound
+		}
+		return
+	}
+	return addrs, _RESOLVER_SYSTEM_TTL, nil
+}
+
+func (r *CacheResolver) lookupServer(host string) (
+	ips []net.IP, ttl time.Duration, err error) {
+	qtypes := []uint16{}
+	if r.prefer != RESOLVER_IPV6_ONLY {
+		qtypes = append(qtypes, DNS_TYPE_A)
+	}
+	if r.prefer != RESOLVER_IPV4_ONLY {
+		qtypes = append(qtypes, DNS_TYPE_AAAA)
+	}
+
+	type answer struct {
+		records []*dnsRecord
+		err     error
+	}
+	ch := make(chan *answer, len(qtypes))
+	for _, qtype := range qtypes {
+		go func(qtype uint16) {
+			records, err := dnsExchange(r.network, r.server, host, qtype,
+				r.timeout)
+			ch <- &answer{records, err}
+		}(qtype)
+	}
+
+	minTTL := ^uint32(0)
+	for range qtypes {
+		a := <-ch
+		if a.err != nil {
+			err = a.err
+			continue
+		}
+		for _, rec := range a.records {
+			if (rec.typ == DNS_TYPE_A && len(rec.data) == net.IPv4len) ||
+				(rec.typ == DNS_TYPE_AAAA && len(rec.data) == net.IPv6len) {
+				ips = append(ips, net.IP(append([]byte{}, rec.data...)))
+				if rec.ttl < minTTL {
+					minTTL = rec.ttl
+				}
+			}
+		}
+	}
+
+	// one family answering is enough
+	if len(ips) > 0 {
+		return ips, time.Duration(minTTL) * time.Second, nil
+	}
+	if err == nil {
+		err = ErrDNSNotFound
+	}
+	return nil, 0, err
+}
+
+// LookupAddr returns the names of ip, from the static hosts first, then
+// from the PTR records. Answers are cached under the reverse name.
+func (r *CacheResolver) LookupAddr(ip net.IP) (names []string, err error) {
+	for host, ips := range r.hosts {
+		for _, i := range ips {
+			if i.Equal(ip) {
+				names = append(names, host)
+			}
+		}
+	}
+	if len(names) > 0 {
+		sort.Strings(names)
+		return names, nil
+	}
+
+	key := reverseName(ip)
+	now := time.Now()
+	r.cacheLock.Lock()
+	e, exist := r.cache[key]
+	r.cacheLock.Unlock()
+	if exist && now.Before(e.expire) {
+		return e.names, e.err
+	}
+
+	ttl := _RESOLVER_SYSTEM_TTL
+	if r.server == "" {
+		names, err = net.LookupAddr(ip.String())
+		if e, ok := err.(*net.DNSError); ok && e.IsNotFound {
+			err = ErrDNSNotFound
+		}
+	} else {
+		var records []*dnsRecord
+		records, err = dnsExchange(r.network, r.server, key, DNS_TYPE_PTR,
+			r.timeout)
+		minTTL := ^uint32(0)
+		for _, rec := range records {
+			if rec.typ == DNS_TYPE_PTR && rec.name != "" {
+				names = append(names, rec.name)
+				if rec.ttl < minTTL {
+					minTTL = rec.ttl
+				}
+			}
+		}
+		ttl = time.Duration(minTTL) * time.Second
+	}
+	for i := range names {
+		names[i] = strings.TrimSuffix(names[i], ".")
+	}
+	if err == nil && len(names) == 0 {
+		err = ErrDNSNotFound
+	}
+	if err == ErrDNSNotFound {
+		names, ttl = nil, _RESOLVER_NEGATIVE_TTL
+	} else if err != nil {
+		return
+	}
+
+	if ttl > 0 {
+		r.store(key, &resolverCacheEntry{
+			names:  names,
+			err:    err,
+			expire: now.Add(ttl),
+		})
+	}
+	return
+}
+
+// store caches e under key, making room first when the cache is full.
+func (r *CacheResolver) store(key string, e *resolverCacheEntry) {
+	r.cacheLock.Lock()
+	defer r.cacheLock.Unlock()
+
+	_, exist := r.cache[key]
+	if !exist && len(r.cache) >= _RESOLVER_CACHE_SIZE {
+		r.evict()
+	}
+	r.cache[key] = e
+}
+
+// evict sweeps the expired entries, and when it frees nothing, drops the
+// quarter of the entries expiring first.
+func (r *CacheResolver) evict() {
+	now := time.Now()
+	keys := make([]string, 0, len(r.cache))
+	for k, e := range r.cache {
+		if now.Before(e.expire) {
+			keys = append(keys, k)
+		} else {
+			delete(r.cache, k)
+		}
+	}
+	if len(keys) < _RESOLVER_CACHE_SIZE {
+		return
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return r.cache[keys[i]].expire.Before(r.cache[keys[j]].expire)
+	})
+	for _, k := range keys[:len(keys)/4] {
+		delete(r.cache, k)
+	}
+}
+
+// sortIPs filters and orders ips by the address family preference.
+func (r *CacheResolver) sortIPs(ips []net.IP) []net.IP {
+	v4, v6 := []net.IP{}, []net.IP{}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	switch r.prefer {
+	case RESOLVER_IPV4_ONLY:
+		return v4
+	case RESOLVER_IPV6_ONLY:
+		return v6
+	case RESOLVER_PREFER_IPV6:
+		return append(v6, v4...)
+	default:
+		return append(v4, v6...)
+	}
+}
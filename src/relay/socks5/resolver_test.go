@@ -0,0 +1,389 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type stubRecord struct {
+	ip  net.IP
+	ttl uint32
+}
+
+// stubDNSServer answers A and AAAA questions over udp and tcp on the same
+// port, from records. Names in truncated get a truncated udp answer.
+type stubDNSServer struct {
+	pc   net.PacketConn
+	l    net.Listener
+	addr string
+
+	records   map[string][]*stubRecord
+	truncated map[string]bool
+
+	// names whose udp answer comes after a forged one, answering the
+	// same id but another question type
+	spoofed map[string]bool
+
+	queries map[string]int
+	lock    *sync.Mutex
+}
+
+func newStubDNSServer(t *testing.T) *stubDNSServer {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		t.Fatal(err)
+	}
+
+	s := &stubDNSServer{
+		pc:        pc,
+		l:         l,
+		addr:      pc.LocalAddr().String(),
+		records:   map[string][]*stubRecord{},
+		truncated: map[string]bool{},
+		spoofed:   map[string]bool{},
+		queries:   map[string]int{},
+		lock:      &sync.Mutex{},
+	}
+	go s.serveUDP()
+	go s.serveTCP()
+	t.Cleanup(func() {
+		pc.Close()
+		l.Close()
+	})
+	return s
+}
+
+func (s *stubDNSServer) add(name string, ip string, ttl uint32) {
+	s.lock.Lock()
+	s.records[name] = append(s.records[name],
+		&stubRecord{net.ParseIP(ip), ttl})
+	s.lock.Unlock()
+}
+
+// count returns the number of questions about name over network.
+func (s *stubDNSServer) count(network, name string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.queries[network+" "+name]
+}
+
+func (s *stubDNSServer) serveUDP() {
+	buf := make([]byte, _DNS_UDP_MSG_LEN)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if forged := s.forge(buf[:n]); forged != nil {
+			s.pc.WriteTo(forged, addr)
+		}
+		if resp := s.answer("udp", buf[:n]); resp != nil {
+			s.pc.WriteTo(resp, addr)
+		}
+	}
+}
+
+func (s *stubDNSServer) serveTCP() {
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			var l uint16
+			if err := binary.Read(conn, binary.BigEndian, &l); err != nil {
+				return
+			}
+			query := make([]byte, l)
+			if _, err := io.ReadFull(conn, query); err != nil {
+				return
+			}
+			if resp := s.answer("tcp", query); resp != nil {
+				binary.Write(conn, binary.BigEndian, uint16(len(resp)))
+				conn.Write(resp)
+			}
+		}()
+	}
+}
+
+func (s *stubDNSServer) answer(network string, query []byte) []byte {
+	if len(query) < _DNS_HEADER_LEN {
+		return nil
+	}
+	name, off, err := readDNSName(query, _DNS_HEADER_LEN)
+	if err != nil || off+4 > len(query) {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(query[off:])
+	question := query[_DNS_HEADER_LEN : off+4]
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.queries[network+" "+name] += 1
+
+	flags := uint16(_DNS_FLAG_QR | _DNS_FLAG_RD)
+	answers := []*stubRecord{}
+	records, exist := s.records[name]
+	switch {
+	case network == "udp" && s.truncated[name]:
+		flags |= _DNS_FLAG_TC
+	case !exist:
+		flags |= DNS_RCODE_NXDOMAIN
+	default:
+		for _, r := range records {
+			if (qtype == DNS_TYPE_A) == (r.ip.To4() != nil) {
+				answers = append(answers, r)
+			}
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, []uint16{
+		binary.BigEndian.Uint16(query), flags, 1, uint16(len(answers)),
+		0, 0})
+	buf.Write(question)
+	for _, r := range answers {
+		data := r.ip.To4()
+		if qtype == DNS_TYPE_AAAA {
+			data = r.ip.To16()
+		}
+		// the name points to the question
+		binary.Write(buf, binary.BigEndian, []uint16{
+			0xc000 | _DNS_HEADER_LEN, qtype, DNS_CLASS_IN})
+		binary.Write(buf, binary.BigEndian, r.ttl)
+		binary.Write(buf, binary.BigEndian, uint16(len(data)))
+		buf.Write(data)
+	}
+	return buf.Bytes()
+}
+
+// forge returns the answer to query with the other address type, when
+// the name is spoofed.
+func (s *stubDNSServer) forge(query []byte) []byte {
+	name, off, err := readDNSName(query, _DNS_HEADER_LEN)
+	if err != nil || off+4 > len(query) {
+		return nil
+	}
+	s.lock.Lock()
+	spoofed := s.spoofed[name]
+	s.lock.Unlock()
+	if !spoofed {
+		return nil
+	}
+
+	q := append([]byte{}, query...)
+	qtype := uint16(DNS_TYPE_AAAA)
+	if binary.BigEndian.Uint16(q[off:]) == DNS_TYPE_AAAA {
+		qtype = DNS_TYPE_A
+	}
+	binary.BigEndian.PutUint16(q[off:], qtype)
+	return s.answer("forged", q)
+}
+
+func newTestResolver(t *testing.T, conf *ResolverConfig) *CacheResolver {
+	r, err := NewResolver(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func equalIPs(ips []net.IP, expect ...string) bool {
+	if len(ips) != len(expect) {
+		return false
+	}
+	for i, ip := range ips {
+		if !ip.Equal(net.ParseIP(expect[i])) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestResolverTTL(t *testing.T) {
+	s := newStubDNSServer(t)
+	s.add("short.test", "10.0.0.1", 1)
+	s.add("long.test", "10.0.0.2", 3600)
+	s.add("long.test", "fd00::2", 3600)
+	r := newTestResolver(t, &ResolverConfig{Server: s.addr})
+
+	for i := 0; i < 2; i++ {
+		ips, err := r.LookupIP("long.test")
+		if err != nil || !equalIPs(ips, "10.0.0.2", "fd00::2") {
+			t.Fatalf("long.test: %v %v", ips, err)
+		}
+		if ips, err = r.LookupIP("short.test"); err != nil ||
+			!equalIPs(ips, "10.0.0.1") {
+			t.Fatalf("short.test: %v %v", ips, err)
+		}
+	}
+	if n := s.count("udp", "short.test"); n != 2 {
+		t.Fatalf("short.test asked %d times before expiry", n)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	r.LookupIP("short.test")
+	r.LookupIP("long.test")
+	if n := s.count("udp", "short.test"); n != 4 {
+		t.Fatalf("short.test asked %d times after expiry", n)
+	}
+	if n := s.count("udp", "long.test"); n != 2 {
+		t.Fatalf("long.test asked %d times", n)
+	}
+}
+
+func TestResolverNegativeCache(t *testing.T) {
+	defer func(ttl time.Duration) { _RESOLVER_NEGATIVE_TTL = ttl }(
+		_RESOLVER_NEGATIVE_TTL)
+	_RESOLVER_NEGATIVE_TTL = 500 * time.Millisecond
+
+	s := newStubDNSServer(t)
+	r := newTestResolver(t, &ResolverConfig{
+		Server: s.addr,
+		Prefer: RESOLVER_IPV4_ONLY,
+	})
+
+	for i := 0; i < 3; i++ {
+		if _, err := r.LookupIP("missing.test"); err != ErrDNSNotFound {
+			t.Fatalf("missing.test: %v", err)
+		}
+	}
+	if n := s.count("udp", "missing.test"); n != 1 {
+		t.Fatalf("missing.test asked %d times", n)
+	}
+
+	s.add("missing.test", "10.0.0.3", 60)
+	time.Sleep(600 * time.Millisecond)
+	if ips, err := r.LookupIP("missing.test"); err != nil ||
+		!equalIPs(ips, "10.0.0.3") {
+		t.Fatalf("missing.test after negative ttl: %v %v", ips, err)
+	}
+}
+
+func TestResolverHosts(t *testing.T) {
+	s := newStubDNSServer(t)
+	s.add("static.test", "10.0.0.4", 60)
+	r := newTestResolver(t, &ResolverConfig{
+		Server: s.addr,
+		Hosts: map[string][]string{
+			"Static.Test.": {"192.168.0.4", "fd00::4"},
+			"v6.test":      {"fd00::5"},
+		},
+		Prefer: RESOLVER_PREFER_IPV6,
+	})
+
+	ips, err := r.LookupIP("static.test")
+	if err != nil || !equalIPs(ips, "fd00::4", "192.168.0.4") {
+		t.Fatalf("static.test: %v %v", ips, err)
+	}
+	if n := s.count("udp", "static.test"); n != 0 {
+		t.Fatalf("static.test asked %d times", n)
+	}
+
+	names, err := r.LookupAddr(net.ParseIP("fd00::5"))
+	if err != nil || len(names) != 1 || names[0] != "v6.test" {
+		t.Fatalf("fd00::5: %v %v", names, err)
+	}
+
+	r = newTestResolver(t, &ResolverConfig{
+		Server: s.addr,
+		Hosts:  map[string][]string{"v6.test": {"fd00::5"}},
+		Prefer: RESOLVER_IPV4_ONLY,
+	})
+	if _, err = r.LookupIP("v6.test"); err != ErrDNSNotFound {
+		t.Fatalf("v6.test ipv4 only: %v", err)
+	}
+}
+
+func TestResolverTruncated(t *testing.T) {
+	s := newStubDNSServer(t)
+	s.add("big.test", "10.0.0.6", 60)
+	s.lock.Lock()
+	s.truncated["big.test"] = true
+	s.lock.Unlock()
+	r := newTestResolver(t, &ResolverConfig{
+		Server: s.addr,
+		Prefer: RESOLVER_IPV4_ONLY,
+	})
+
+	ips, err := r.LookupIP("big.test")
+	if err != nil || !equalIPs(ips, "10.0.0.6") {
+		t.Fatalf("big.test: %v %v", ips, err)
+	}
+	if s.count("udp", "big.test") != 1 || s.count("tcp", "big.test") != 1 {
+		t.Fatalf("big.test asked %d times over udp, %d over tcp",
+			s.count("udp", "big.test"), s.count("tcp", "big.test"))
+	}
+}
+
+func TestResolverCacheSize(t *testing.T) {
+	r := newTestResolver(t, nil)
+	now := time.Now()
+	for i := 0; i < _RESOLVER_CACHE_SIZE+10; i++ {
+		expire := now.Add(time.Duration(i+1) * time.Second)
+		r.store(reverseName(net.IPv4(10, 1, byte(i>>8), byte(i))),
+			&resolverCacheEntry{expire: expire})
+	}
+	if len(r.cache) > _RESOLVER_CACHE_SIZE {
+		t.Fatalf("%d entries cached", len(r.cache))
+	}
+	if _, exist := r.cache[reverseName(net.IPv4(10, 1, 0, 0))]; exist {
+		t.Fatal("the entry expiring first is not evicted")
+	}
+}
+
+func TestResolverConfig(t *testing.T) {
+	for _, conf := range []*ResolverConfig{
+		{Prefer: "ipv5"},
+		{Network: "sctp"},
+		{Timeout: -1},
+		{Hosts: map[string][]string{"bad.test": {"10.0.0"}}},
+	} {
+		if _, err := NewResolver(conf); err != ErrResolverConfig {
+			t.Fatalf("%+v: %v", conf, err)
+		}
+	}
+}
+
+func TestResolverQuestion(t *testing.T) {
+	s := newStubDNSServer(t)
+	s.add("spoof.test", "10.0.0.7", 60)
+	s.add("spoof.test", "fd00::7", 60)
+	s.lock.Lock()
+	s.spoofed["spoof.test"] = true
+	s.lock.Unlock()
+	r := newTestResolver(t, &ResolverConfig{
+		Server: s.addr,
+		Prefer: RESOLVER_IPV4_ONLY,
+	})
+
+	ips, err := r.LookupIP("spoof.test")
+	if err != nil || !equalIPs(ips, "10.0.0.7") {
+		t.Fatalf("spoof.test: %v %v", ips, err)
+	}
+
+	msg := s.answer("test", mustQuery(t, 1, "other.test", DNS_TYPE_A))
+	if _, _, err = parseDNSResponse(msg, 1, "spoof.test",
+		DNS_TYPE_A); err != ErrDNSQuestion {
+		t.Fatalf("answer of other.test: %v", err)
+	}
+}
+
+func mustQuery(t *testing.T, id uint16, name string, qtype uint16) []byte {
+	q, err := buildDNSQuery(id, name, qtype)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
@@ -0,0 +1,375 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	OUTBOUND_DIRECT = "direct" // dial the destination from this host
+	OUTBOUND_REJECT = "reject" // refuse with REP_CONN_NOT_ALLOWED
+	OUTBOUND_SOCKS5 = "socks5" // relay through an upstream socks5 server
+
+	// relay through a socks5 server running behind a reversetunnel
+	// slaver, addr is the master side address of that tunnel
+	OUTBOUND_SLAVER = "slaver"
+)
+
+type Outbound interface {
+	Name() string
+	Dial(ctx context.Context, req *Request) (net.Conn, error)
+}
+
+type OutboundConfig struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Addr     string `json:"addr,omitempty"`
+	User     string `json:"user,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	// source ip and/or interface of the outgoing connections, instead of
+	// the ones of the listener dialer
+	BindAddr      string `json:"bind_addr,omitempty"`
+	BindInterface string `json:"bind_interface,omitempty"`
+
+	// direct outbounds only, address family tried first, "ipv4" or
+	// "ipv6", and milliseconds between two connection attempts
+	Prefer       string `json:"prefer,omitempty"`
+	AttemptDelay int    `json:"attempt_delay,omitempty"`
+
+	// socks5 and slaver outbounds only, talk to the server over tls
+	TLS *TLSConfig `json:"tls,omitempty"`
+}
+
+// A rule matches when every non empty field matches, a field matches when
+// any of its values does.
+type RuleConfig struct {
+	Domain   []string `json:"domain,omitempty"`
+	CIDR     []string `json:"cidr,omitempty"`
+	Port     []string `json:"port,omitempty"` // "443" or "8000-8999"
+	User     []string `json:"user,omitempty"`
+	Outbound string   `json:"outbound"`
+}
+
+type RouterConfig struct {
+	Outbounds []*OutboundConfig `json:"outbounds,omitempty"`
+	Rules     []*RuleConfig     `json:"rules,omitempty"`
+	Default   string            `json:"default,omitempty"`
+}
+
+type directOutbound struct {
+	name     string
+	resolver Resolver
+	dialer   Dialer
+	prefer   string
+	delay    time.Duration
+}
+
+func (o *directOutbound) Name() string { return o.name }
+
+func (o *directOutbound) Dial(ctx context.Context, req *Request) (
+	conn net.Conn, err error) {
+	ips := []net.IP{req.IP}
+	if req.IP == nil {
+		if ips, err = o.resolver.LookupIP(req.Host); err != nil {
+			return
+		}
+	}
+
+	var ip net.IP
+	conn, ip, err = dialHappyEyeballs(ctx, o.dialer,
+		interleaveIPs(ips, o.prefer), req.Port, o.delay)
+	if err == nil {
+		req.IP = ip
+	}
+	return
+}
+
+type rejectOutbound struct {
+	name string
+}
+
+func (o *rejectOutbound) Name() string { return o.name }
+
+func (o *rejectOutbound) Dial(ctx context.Context, req *Request) (
+	net.Conn, error) {
+	return nil, ErrRejected
+}
+
+type proxyOutbound struct {
+	name   string
+	client *Client
+}
+
+func (o *proxyOutbound) Name() string { return o.name }
+
+func (o *proxyOutbound) Dial(ctx context.Context, req *Request) (
+	net.Conn, error) {
+	return o.client.DialContext(ctx, "tcp", req.Addr())
+}
+
+func newOutbound(conf *OutboundConfig, resolver Resolver, dialer Dialer) (
+	Outbound, error) {
+	if conf.BindAddr != "" || conf.BindInterface != "" {
+		d, err := NewBindDialer(conf.BindAddr, conf.BindInterface)
+		if err != nil {
+			return nil, err
+		}
+		dialer = d
+	}
+
+	switch conf.Type {
+	case OUTBOUND_DIRECT:
+		if !validPrefer(conf.Prefer) ||
+			strings.HasSuffix(conf.Prefer, "_only") {
+			return nil, ErrResolverConfig
+		}
+		o := &directOutbound{
+			name:     conf.Name,
+			resolver: resolver,
+			dialer:   dialer,
+			prefer:   conf.Prefer,
+			delay:    time.Duration(conf.AttemptDelay) * time.Millisecond,
+		}
+		if o.delay == 0 {
+			o.delay = _DEFAULT_ATTEMPT_DELAY
+		}
+		return o, nil
+	case OUTBOUND_REJECT:
+		return &rejectOutbound{conf.Name}, nil
+	case OUTBOUND_SOCKS5, OUTBOUND_SLAVER:
+		o := &proxyOutbound{
+			name: conf.Name,
+			client: &Client{
+				Addr:     conf.Addr,
+				User:     conf.User,
+				Password: conf.Password,
+				Dialer:   dialer,
+			},
+		}
+		if conf.TLS != nil {
+			var err error
+			if o.client.TLS, err = conf.TLS.ClientConfig(); err != nil {
+				return nil, err
+			}
+		}
+		return o, nil
+	default:
+		return nil, ErrUnknownOutbound
+	}
+}
+
+type portRange struct {
+	from, to uint16
+}
+
+type rule struct {
+	domains  []string
+	cidrs    []*net.IPNet
+	ports    []portRange
+	users    []string
+	outbound Outbound
+}
+
+func (r *rule) matchDomain(req *Request) bool {
+	if len(r.domains) == 0 {
+		return true
+	}
+	host := strings.ToLower(strings.TrimSuffix(req.Domain(), "."))
+	if host == "" {
+		return false
+	}
+	for _, d := range r.domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rule) matchPort(req *Request) bool {
+	if len(r.ports) == 0 {
+		return true
+	}
+	for _, p := range r.ports {
+		if req.Port >= p.from && req.Port <= p.to {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rule) matchUser(req *Request) bool {
+	if len(r.users) == 0 {
+		return true
+	}
+	for _, u := range r.users {
+		if u == req.User {
+			return true
+		}
+	}
+	return false
+}
+
+// matchIP matches when any of the addresses of the target is in the cidrs.
+func (r *rule) matchIP(ips []net.IP) bool {
+	if len(r.cidrs) == 0 {
+		return true
+	}
+	for _, n := range r.cidrs {
+		for _, ip := range ips {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Router picks an outbound for every request, rules are tried in order and
+// the first match wins, requests matching no rule use the default outbound.
+type Router struct {
+	outbounds map[string]Outbound
+	rules     []*rule
+	def       Outbound
+	resolver  Resolver
+}
+
+// NewRouter builds the router described by conf, domain names are resolved
+// with resolver, or DefaultResolver when it is nil, and direct outbounds
+// dial with dialer, or a net.Dialer when it is nil.
+func NewRouter(conf *RouterConfig, resolver Resolver, dialer Dialer) (
+	r *Router, err error) {
+	if resolver == nil {
+		resolver = DefaultResolver
+	}
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	r = &Router{
+		outbounds: map[string]Outbound{
+			OUTBOUND_DIRECT: &directOutbound{
+				name:     OUTBOUND_DIRECT,
+				resolver: resolver,
+				dialer:   dialer,
+				delay:    _DEFAULT_ATTEMPT_DELAY,
+			},
+			OUTBOUND_REJECT: &rejectOutbound{OUTBOUND_REJECT},
+		},
+		resolver: resolver,
+	}
+	if conf == nil {
+		conf = &RouterConfig{}
+	}
+
+	for _, oc := range conf.Outbounds {
+		var o Outbound
+		if o, err = newOutbound(oc, resolver, dialer); err != nil {
+			return nil, err
+		}
+		r.outbounds[oc.Name] = o
+	}
+
+	for _, rc := range conf.Rules {
+		var ru *rule
+		if ru, err = r.newRule(rc); err != nil {
+			return nil, err
+		}
+		r.rules = append(r.rules, ru)
+	}
+
+	def := conf.Default
+	if def == "" {
+		def = OUTBOUND_DIRECT
+	}
+	if r.def = r.outbounds[def]; r.def == nil {
+		return nil, ErrUnknownOutbound
+	}
+
+	return
+}
+
+func (r *Router) newRule(conf *RuleConfig) (ru *rule, err error) {
+	ru = &rule{
+		users:    conf.User,
+		outbound: r.outbounds[conf.Outbound],
+	}
+	if ru.outbound == nil {
+		return nil, ErrUnknownOutbound
+	}
+
+	for _, d := range conf.Domain {
+		ru.domains = append(ru.domains,
+			strings.ToLower(strings.Trim(d, ".")))
+	}
+
+	for _, c := range conf.CIDR {
+		var n *net.IPNet
+		if _, n, err = net.ParseCIDR(c); err != nil {
+			return nil, err
+		}
+		ru.cidrs = append(ru.cidrs, n)
+	}
+
+	for _, p := range conf.Port {
+		var pr portRange
+		if pr, err = parsePortRange(p); err != nil {
+			return nil, err
+		}
+		ru.ports = append(ru.ports, pr)
+	}
+
+	return
+}
+
+func (r *Router) Outbound(name string) Outbound {
+	return r.outbounds[name]
+}
+
+// Route leaves the request unresolved, so that the outbound still gets
+// every address of a domain name.
+func (r *Router) Route(req *Request) Outbound {
+	var ips []net.IP
+	if req.IP != nil {
+		ips = []net.IP{req.IP}
+	}
+	resolved := req.IP != nil
+	for _, ru := range r.rules {
+		if !ru.matchUser(req) || !ru.matchPort(req) || !ru.matchDomain(req) {
+			continue
+		}
+		if len(ru.cidrs) > 0 && !resolved {
+			ips, _ = r.resolver.LookupIP(req.Host)
+			resolved = true
+		}
+		if ru.matchIP(ips) {
+			return ru.outbound
+		}
+	}
+	return r.def
+}
+
+func parsePortRange(s string) (pr portRange, err error) {
+	from, to := s, s
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		from, to = s[:i], s[i+1:]
+	}
+
+	var p uint64
+	if p, err = strconv.ParseUint(strings.TrimSpace(from), 10, 16); err != nil {
+		return
+	}
+	pr.from = uint16(p)
+	if p, err = strconv.ParseUint(strings.TrimSpace(to), 10, 16); err != nil {
+		return
+	}
+	pr.to = uint16(p)
+	if pr.from > pr.to {
+		err = fmt.Errorf("socks5: invalid port range %q", s)
+	}
+	return
+}
@@ -0,0 +1,227 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	_SHUTDOWN_POLL_INTERVAL = 100 * time.Millisecond
+	_ACCEPT_RETRY_MAX_DELAY = 1 * time.Second
+)
+
+// Server accepts socks5 clients on any number of listeners, all sessions
+// share one Options.
+type Server struct {
+	opt atomic.Value // *Options
+
+	listeners map[net.Listener]struct{}
+	sessions  map[uint64]*TCPHandler
+	shutdown  bool
+	lock      *sync.Mutex
+}
+
+func NewServer(opt *Options) *Server {
+	s := &Server{
+		listeners: map[net.Listener]struct{}{},
+		sessions:  map[uint64]*TCPHandler{},
+		lock:      &sync.Mutex{},
+	}
+	s.SetOptions(opt)
+	return s
+}
+
+func (s *Server) options() *Options {
+	return s.opt.Load().(*Options)
+}
+
+// SetOptions replaces the options of new sessions, established sessions
+// keep the options they were accepted with.
+func (s *Server) SetOptions(opt *Options) {
+	s.opt.Store(opt.withDefaults())
+}
+
+func (s *Server) ListenAndServe(network, addr string) error {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts clients on l until l fails or the server is shut down, it
+// always returns an error, ErrServerClosed after Shutdown or Close.
+func (s *Server) Serve(l net.Listener) error {
+	s.lock.Lock()
+	if s.shutdown {
+		s.lock.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.lock.Unlock()
+
+	defer func() {
+		s.lock.Lock()
+		delete(s.listeners, l)
+		s.lock.Unlock()
+		l.Close()
+	}()
+
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isShutdown() {
+				return ErrServerClosed
+			}
+			// out of file descriptors and the like, wait and retry
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > _ACCEPT_RETRY_MAX_DELAY {
+					delay = _ACCEPT_RETRY_MAX_DELAY
+				}
+				s.options().Logger.Error(err)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+
+		handler := NewTCPHandler(conn, s.options())
+		if !s.track(handler) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go s.serveSession(handler)
+	}
+}
+
+func (s *Server) serveSession(handler *TCPHandler) {
+	defer func() {
+		if err := recover(); err != nil {
+			handler.opt.Logger.Error(err, string(debug.Stack()))
+		}
+		handler.Close()
+		s.untrack(handler)
+	}()
+
+	handler.Run()
+}
+
+func (s *Server) track(handler *TCPHandler) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.shutdown {
+		return false
+	}
+	s.sessions[handler.ID()] = handler
+	return true
+}
+
+func (s *Server) untrack(handler *TCPHandler) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.sessions, handler.ID())
+}
+
+func (s *Server) isShutdown() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.shutdown
+}
+
+// closeListeners stops accepting new clients.
+func (s *Server) closeListeners() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.shutdown = true
+	for l := range s.listeners {
+		l.Close()
+	}
+}
+
+func (s *Server) closeSessions() {
+	s.lock.Lock()
+	sessions := make([]*TCPHandler, 0, len(s.sessions))
+	for _, h := range s.sessions {
+		sessions = append(sessions, h)
+	}
+	s.lock.Unlock()
+
+	for _, h := range sessions {
+		h.Close()
+	}
+}
+
+func (s *Server) activeSessions() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.sessions)
+}
+
+// Sessions returns a snapshot of the active sessions.
+func (s *Server) Sessions() []*SessionInfo {
+	s.lock.Lock()
+	sessions := make([]*TCPHandler, 0, len(s.sessions))
+	for _, h := range s.sessions {
+		sessions = append(sessions, h)
+	}
+	s.lock.Unlock()
+
+	infos := make([]*SessionInfo, 0, len(sessions))
+	for _, h := range sessions {
+		infos = append(infos, h.Info())
+	}
+	return infos
+}
+
+// Kill closes the session id, it returns false when no such session is
+// active.
+func (s *Server) Kill(id uint64) bool {
+	s.lock.Lock()
+	handler, exist := s.sessions[id]
+	s.lock.Unlock()
+
+	if !exist {
+		return false
+	}
+	handler.Close()
+	return true
+}
+
+// Shutdown stops accepting new clients and waits for the active sessions
+// to end. When ctx is done first, the remaining sessions are closed and
+// the error of ctx is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.closeListeners()
+
+	ticker := time.NewTicker(_SHUTDOWN_POLL_INTERVAL)
+	defer ticker.Stop()
+	for {
+		if s.activeSessions() == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			s.closeSessions()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close stops accepting new clients and closes every active session.
+func (s *Server) Close() error {
+	s.closeListeners()
+	s.closeSessions()
+	return nil
+}
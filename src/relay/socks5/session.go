@@ -0,0 +1,66 @@
+package socks5
+
+import (
+	"relay"
+	"sync/atomic"
+	"time"
+)
+
+var _SESSION_ID = uint64(0)
+
+func newSessionID() uint64 {
+	return atomic.AddUint64(&_SESSION_ID, 1)
+}
+
+// SessionInfo is a snapshot of a session, the destination fields are empty
+// until the outbound connection is established.
+type SessionInfo struct {
+	ID         uint64    `json:"id"`
+	ClientAddr string    `json:"client_addr"`
+	User       string    `json:"user"`
+	Dest       string    `json:"dest,omitempty"`
+	Sniffed    string    `json:"sniffed_host,omitempty"`
+	IP         string    `json:"ip,omitempty"`
+	Outbound   string    `json:"outbound,omitempty"`
+	Start      time.Time `json:"start"`
+	Up         int64     `json:"up"`
+	Down       int64     `json:"down"`
+}
+
+func (h *TCPHandler) ID() uint64 {
+	return h.id
+}
+
+func (h *TCPHandler) Info() *SessionInfo {
+	info := &SessionInfo{
+		ID:    h.id,
+		Start: h.start,
+		Up:    atomic.LoadInt64(&h.up),
+		Down:  atomic.LoadInt64(&h.down),
+	}
+	if h.req.ClientAddr != nil {
+		info.ClientAddr = h.req.ClientAddr.String()
+	}
+
+	// the request is complete once the outbound is set
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	info.Outbound = h.outbound
+	if h.server != nil {
+		info.User = h.req.User
+		info.Dest = h.req.Addr()
+		info.Sniffed = h.req.SniffedHost
+		if h.req.IP != nil {
+			info.IP = h.req.IP.String()
+		}
+	}
+	return info
+}
+
+func (h *TCPHandler) countHook(dir int, n int) {
+	if dir == relay.DIR_UP {
+		atomic.AddInt64(&h.up, int64(n))
+	} else {
+		atomic.AddInt64(&h.down, int64(n))
+	}
+}
@@ -0,0 +1,29 @@
+package socks5
+
+import (
+	"relay"
+	"strings"
+	"time"
+)
+
+var _DEFAULT_SNIFF_TIMEOUT = 300 * time.Millisecond
+
+// sniff reads the first bytes of the client, until a host name is found
+// or timeout, the bytes read are kept to be sent to the server.
+func (h *TCPHandler) sniff() {
+	buf := make([]byte, relay.SNIFF_BUFFER_SIZE)
+	n := 0
+
+	h.conn.SetReadDeadline(time.Now().Add(h.opt.SniffTimeout))
+	for n < len(buf) {
+		m, err := h.conn.Read(buf[n:])
+		n += m
+		if host, more := relay.SniffHost(buf[:n]); host != "" {
+			h.req.SniffedHost = strings.ToLower(host)
+			break
+		} else if !more || err != nil {
+			break
+		}
+	}
+	h.peeked = buf[:n]
+}
@@ -1,69 +1,177 @@
 package socks5
 
 import (
+	"context"
+	"crypto/tls"
 	"io"
 	"net"
-	"strconv"
-
-	"github.com/solomonwzs/goxutil/logger"
+	"relay"
+	"sync"
+	"time"
 )
 
 var (
 	_REPLY_NO_AUTH   = []byte{PROTO_VER, PROTO_METHOD_NOAUTH}
 	_REPLY_NO_ACCEPT = []byte{PROTO_VER, PROTO_METHOD_NOT_ACCEPTABLE}
-
-	_REPLY_GEN_SOCKS_SERVER_FAILURE = []byte{
-		PROTO_VER,
-		REP_GEN_SOCKS_SERVER_FAILURE,
-		0x00,
-		ATYP_IPV4,
-		0x00, 0x00, 0x00, 0x00,
-		0x00, 0x00,
-	}
-	_REPLY_GEN_SOCKS_SERVER_SUCCESS = []byte{
-		PROTO_VER,
-		REP_SUCCESS,
-		0x00,
-		ATYP_IPV4,
-		0x00, 0x00, 0x00, 0x00,
-		0x00, 0x00,
-	}
 )
 
 type TCPHandler struct {
 	conn   net.Conn
 	server net.Conn
+	opt    *Options
+	req    *Request
+	meter  *Meter
+
+	id       uint64
+	start    time.Time
+	outbound string
+	up       int64
+	down     int64
+	rep      int
+	result   *relay.Result
+	peeked   []byte
+
+	closed bool
+	lock   *sync.Mutex
 }
 
-func NewTCPHandler(conn net.Conn) *TCPHandler {
+func NewTCPHandler(conn net.Conn, opt *Options) *TCPHandler {
+	opt = opt.withDefaults()
+	if opt.TLS != nil {
+		conn = tls.Server(conn, opt.TLS)
+	}
+
 	handler := TCPHandler{
 		conn:   conn,
 		server: nil,
+		opt:    opt,
+		req:    &Request{ClientAddr: conn.RemoteAddr()},
+		id:     newSessionID(),
+		start:  time.Now(),
+		rep:    -1,
+		lock:   &sync.Mutex{},
 	}
 	return &handler
 }
 
 func (h *TCPHandler) Run() {
-	if err := h.stageMethodNegotiation(); err != nil {
-		logger.Error(err)
+	var err error
+	if h.opt.AccessLog != nil {
+		defer func() { h.opt.AccessLog.Log(h.accessRecord(err)) }()
+	}
+
+	if h.opt.RateLimiter != nil && !h.opt.RateLimiter.AllowConn(
+		h.req.ClientAddr) {
+		err = ErrConnRate
+		h.opt.Logger.Error(err)
 		return
 	}
 
-	if err := h.stageAddr(); err != nil {
-		logger.Error(err)
+	setKeepAlive(h.conn, h.opt.KeepAlive)
+	h.conn.SetDeadline(time.Now().Add(h.opt.HandshakeTimeout))
+
+	if h.opt.Transparent != "" {
+		if err = h.stageTransparent(); err != nil {
+			h.opt.Logger.Error(err)
+			return
+		}
+	} else {
+		if err = h.stageTLS(); err != nil {
+			h.opt.Logger.Error(err)
+			return
+		}
+
+		if err = h.stageMethodNegotiation(); err != nil {
+			h.opt.Logger.Error(err)
+			return
+		}
+
+		if err = h.stageAddr(); err != nil {
+			h.opt.Logger.Error(err)
+			return
+		}
+	}
+
+	// resolve requests end with the reply
+	if h.server == nil {
 		return
 	}
 
+	h.conn.SetDeadline(time.Time{})
+	setKeepAlive(h.server, h.opt.KeepAlive)
 	h.stageTransport()
+	if h.meter != nil && h.meter.exceeded() {
+		err = ErrQuota
+	}
+}
+
+func (h *TCPHandler) accessRecord(err error) *AccessRecord {
+	info := h.Info()
+	r := &AccessRecord{
+		Time:       time.Now(),
+		ID:         info.ID,
+		ClientAddr: info.ClientAddr,
+		User:       h.req.User,
+		Command:    commandName(h.req.Command),
+		Outbound:   info.Outbound,
+		Rep:        h.rep,
+		Up:         info.Up,
+		Down:       info.Down,
+		Duration:   int64(time.Since(h.start) / time.Millisecond),
+	}
+	if h.req.Host != "" {
+		r.Dest = h.req.Addr()
+	}
+	r.Sniffed = h.req.SniffedHost
+	if h.req.IP != nil {
+		r.IP = h.req.IP.String()
+	}
+	if h.result != nil {
+		r.Close = h.result.ReasonString()
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	return r
 }
 
+func (h *TCPHandler) writeReply(rep byte, addr net.Addr) (err error) {
+	h.rep = int(rep)
+	_, err = h.conn.Write(newReply(rep, addr))
+	return
+}
+
+// Close ends the session, it is safe to call from any goroutine and more
+// than once.
 func (h *TCPHandler) Close() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.closed = true
 	if h.conn != nil {
 		h.conn.Close()
 	}
 	if h.server != nil {
 		h.server.Close()
 	}
+	if h.meter != nil {
+		h.meter.Close()
+	}
+}
+
+// setServer keeps the outbound connection, which is closed at once when
+// the session was closed meanwhile.
+func (h *TCPHandler) setServer(conn net.Conn, outbound string) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.closed {
+		conn.Close()
+		return false
+	}
+	h.server = conn
+	h.outbound = outbound
+	return true
 }
 
 func (h *TCPHandler) stageMethodNegotiation() (err error) {
@@ -80,10 +188,17 @@ func (h *TCPHandler) stageMethodNegotiation() (err error) {
 	if _, err = io.ReadFull(h.conn, buf[:nMethods]); err != nil {
 		return
 	}
+	// a client certificate already authenticated the user
+	noAuth := h.opt.Auth == nil || h.req.User != ""
 	for i := byte(0); i < nMethods; i++ {
-		if buf[i] == PROTO_METHOD_NOAUTH {
+		if noAuth && buf[i] == PROTO_METHOD_NOAUTH {
 			_, err = h.conn.Write(_REPLY_NO_AUTH)
 			return
+		} else if !noAuth && buf[i] == PROTO_METHOD_PASSWORD {
+			if _, err = h.conn.Write(_REPLY_PASSWORD); err != nil {
+				return
+			}
+			return h.stagePasswordAuth()
 		}
 	}
 
@@ -94,13 +209,24 @@ func (h *TCPHandler) stageMethodNegotiation() (err error) {
 	}
 }
 
-func (h *TCPHandler) stageAddr() (err error) {
-	var (
-		buf  = make([]byte, 0xff, 0xff)
-		host string
-		port string
-	)
+func (h *TCPHandler) stagePasswordAuth() (err error) {
+	user, password, err := readPasswordAuth(h.conn)
+	if err != nil {
+		return
+	}
 
+	if !h.opt.Auth.Authenticate(user, password) {
+		h.conn.Write(_REPLY_AUTH_FAIL)
+		return ErrAuthFailed
+	}
+
+	h.req.User = user
+	_, err = h.conn.Write(_REPLY_AUTH_OK)
+	return
+}
+
+func (h *TCPHandler) stageAddr() (err error) {
+	buf := make([]byte, 4, 4)
 	if _, err = io.ReadFull(h.conn, buf[:4]); err != nil {
 		return
 	}
@@ -110,51 +236,180 @@ func (h *TCPHandler) stageAddr() (err error) {
 		return ErrVersion
 	}
 
+	h.req.Command = cmd
 	if cmd == CMD_CONNECT {
-		switch atyp {
-		case ATYP_IPV4:
-			if _, err = io.ReadFull(h.conn, buf[:4]); err != nil {
-				return
+		if h.req.Host, h.req.Port, err = readAddr(h.conn, atyp); err != nil {
+			if err == ErrUnknownAddrType {
+				h.writeReply(REP_ADDR_TYPE_NOT_SUPPORTED, nil)
 			}
-			host = net.IP(buf[:4]).String()
-		case ATYP_DOMAINNAME:
-			if _, err = io.ReadFull(h.conn, buf[:1]); err != nil {
-				return
-			}
-			domainLen := buf[0]
+			return
+		}
 
-			if _, err = io.ReadFull(h.conn, buf[:domainLen]); err != nil {
-				return
+		return h.connect(true)
+	} else if cmd == CMD_RESOLVE || cmd == CMD_RESOLVE_PTR {
+		return h.stageResolve(atyp)
+	} else {
+		h.writeReply(REP_CMD_NOT_SUPPORTED, nil)
+		return ErrUnknownCommand
+	}
+}
+
+// connect routes and dials the request, the socks client gets a reply when
+// reply is true.
+func (h *TCPHandler) connect(reply bool) (err error) {
+	if h.opt.Accounting != nil {
+		if h.meter, err = h.opt.Accounting.Open(h.req); err != nil {
+			if reply {
+				h.writeReply(REP_CONN_NOT_ALLOWED, nil)
 			}
-			host = string(buf[:domainLen])
-		case ATYP_IPV6:
-			if _, err = io.ReadFull(h.conn, buf[:16]); err != nil {
+			return
+		}
+		h.meter.onQuota = h.Close
+	}
+
+	// a socks client sends nothing before the reply
+	if h.opt.Sniff && !h.req.IsDomain() {
+		if reply {
+			if err = h.writeReply(REP_SUCCESS, nil); err != nil {
 				return
 			}
-			host = net.IP(buf[:16]).String()
-		default:
-			return ErrUnknownAddrType
+			reply = false
+		}
+		h.sniff()
+		if h.meter != nil && h.req.SniffedHost != "" {
+			h.meter.setDest(h.req.SniffedHost)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		h.opt.DialTimeout)
+	defer cancel()
+
+	outbound := h.opt.Router.Route(h.req)
+	var server net.Conn
+	if server, err = outbound.Dial(ctx, h.req); err != nil {
+		h.lock.Lock()
+		h.outbound = outbound.Name()
+		h.lock.Unlock()
+		if reply {
+			h.writeReply(replyCode(err), nil)
+		} else {
+			// the client got a success already, keep the real outcome for
+			// the access log and the stats
+			h.rep = int(replyCode(err))
 		}
+		return
+	}
+	if !h.setServer(server, outbound.Name()) {
+		return ErrSessionClosed
+	}
 
-		if _, err = io.ReadFull(h.conn, buf[:2]); err != nil {
+	if len(h.peeked) > 0 {
+		if _, err = server.Write(h.peeked); err != nil {
 			return
 		}
-		port = strconv.Itoa(int(buf[0])<<8 | int(buf[1]))
+		h.countHook(relay.DIR_UP, len(h.peeked))
+		if h.meter != nil {
+			h.meter.hook(relay.DIR_UP, len(h.peeked))
+		}
+	}
+
+	if reply {
+		err = h.writeReply(REP_SUCCESS, nil)
+	}
+	return
+}
+
+// stageResolve answers RESOLVE with an address of the requested name, and
+// RESOLVE_PTR with the name of the requested address.
+func (h *TCPHandler) stageResolve(atyp byte) (err error) {
+	if h.req.Host, h.req.Port, err = readAddr(h.conn, atyp); err != nil {
+		if err == ErrUnknownAddrType {
+			h.writeReply(REP_ADDR_TYPE_NOT_SUPPORTED, nil)
+		}
+		return
+	}
 
-		if h.server, err = net.Dial(
-			"tcp", net.JoinHostPort(host, port)); err != nil {
-			h.conn.Write(_REPLY_GEN_SOCKS_SERVER_FAILURE)
+	outbound := h.opt.Router.Route(h.req)
+	h.lock.Lock()
+	h.outbound = outbound.Name()
+	h.lock.Unlock()
+	if _, ok := outbound.(*rejectOutbound); ok {
+		h.writeReply(REP_CONN_NOT_ALLOWED, nil)
+		return ErrRejected
+	}
+
+	if h.req.Command == CMD_RESOLVE {
+		var ips []net.IP
+		if ips, err = h.opt.Resolver.LookupIP(h.req.Host); err != nil {
+			h.writeReply(replyCode(err), nil)
 			return
+		} else if len(ips) == 0 {
+			h.writeReply(REP_HOST_UNREACHABLE, nil)
+			return ErrDNSNotFound
 		}
+		h.req.IP = ips[0]
+		return h.writeReply(REP_SUCCESS, &net.TCPAddr{IP: h.req.IP})
+	}
+
+	ip := net.ParseIP(h.req.Host)
+	if ip == nil {
+		h.writeReply(REP_ADDR_TYPE_NOT_SUPPORTED, nil)
+		return ErrUnknownAddrType
+	}
+	h.req.IP = ip
 
-		_, err = h.conn.Write(_REPLY_GEN_SOCKS_SERVER_SUCCESS)
+	var names []string
+	if names, err = h.opt.Resolver.LookupAddr(ip); err != nil {
+		h.writeReply(replyCode(err), nil)
 		return
-	} else {
-		return ErrUnknownCommand
+	} else if len(names) == 0 {
+		h.writeReply(REP_HOST_UNREACHABLE, nil)
+		return ErrDNSNotFound
 	}
+	h.rep = REP_SUCCESS
+	_, err = h.conn.Write(newHostReply(REP_SUCCESS, names[0], 0))
+	return
 }
 
 func (handler *TCPHandler) stageTransport() {
-	go io.Copy(handler.server, handler.conn)
-	io.Copy(handler.conn, handler.server)
+	opt := &relay.Options{
+		Hooks:       []relay.Hook{handler.countHook},
+		IdleTimeout: handler.opt.IdleTimeout,
+	}
+	if m := handler.meter; m != nil {
+		opt.Hooks = append(opt.Hooks, m.hook)
+	}
+	if l := handler.opt.RateLimiter; l != nil {
+		hook, done := l.hook(handler.req.User)
+		defer done()
+		opt.Hooks = append(opt.Hooks, hook)
+	}
+
+	handler.result = relay.Relay(handler.conn, handler.server, opt)
+}
+
+func setKeepAlive(conn net.Conn, d time.Duration) {
+	if c, ok := conn.(*tls.Conn); ok {
+		conn = c.NetConn()
+	}
+	if c, ok := conn.(*net.TCPConn); ok {
+		if d < 0 {
+			c.SetKeepAlive(false)
+		} else {
+			c.SetKeepAlive(true)
+			c.SetKeepAlivePeriod(d)
+		}
+	}
+}
+
+func replyCode(err error) byte {
+	if err == ErrRejected {
+		return REP_CONN_NOT_ALLOWED
+	} else if err == ErrDNSNotFound {
+		return REP_HOST_UNREACHABLE
+	} else if e, ok := err.(*ReplyError); ok {
+		return e.Rep
+	}
+	return REP_GEN_SOCKS_SERVER_FAILURE
 }
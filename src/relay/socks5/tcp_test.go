@@ -0,0 +1,97 @@
+package socks5
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+type testAccessLog struct {
+	records chan *AccessRecord
+}
+
+func (l *testAccessLog) Log(r *AccessRecord) { l.records <- r }
+
+// sniffSession connects through a sniffing handler to addr and sends the
+// http request of host, it returns the reply code and the access record.
+func sniffSession(t *testing.T, opt *Options, addr *net.TCPAddr,
+	host string) (byte, *AccessRecord) {
+	log := &testAccessLog{records: make(chan *AccessRecord, 1)}
+	opt.Sniff = true
+	opt.AccessLog = log
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	h := NewTCPHandler(conn, opt)
+	ended := make(chan bool)
+	go func() {
+		h.Run()
+		h.Close()
+		close(ended)
+	}()
+
+	client.Write([]byte{PROTO_VER, 1, PROTO_METHOD_NOAUTH})
+	buf := make([]byte, 10)
+	io.ReadFull(client, buf[:2])
+	client.Write([]byte{PROTO_VER, CMD_CONNECT, 0, ATYP_IPV4, 127, 0, 0, 1,
+		byte(addr.Port >> 8), byte(addr.Port)})
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatal(err)
+	}
+	client.Write([]byte("GET / HTTP/1.1\r\nHost: " + host + "\r\n\r\n"))
+	ioutil.ReadAll(client)
+	<-ended
+	return buf[1], <-log.records
+}
+
+func TestSniffRejectLogged(t *testing.T) {
+	router, err := NewRouter(&RouterConfig{Rules: []*RuleConfig{
+		{Domain: []string{"blocked.example"}, Outbound: OUTBOUND_REJECT},
+	}}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rep, r := sniffSession(t, &Options{Router: router},
+		&net.TCPAddr{Port: 80}, "www.blocked.example")
+	if rep != REP_SUCCESS {
+		t.Fatalf("reply %d before the sniff", rep)
+	}
+	if r.Rep != REP_CONN_NOT_ALLOWED || r.Error != ErrRejected.Error() ||
+		r.Outbound != OUTBOUND_REJECT || r.Sniffed != "www.blocked.example" {
+		t.Fatalf("access record %+v", r)
+	}
+}
+
+func TestSniffAccountingDest(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		c.Read(make([]byte, 1024))
+		c.Write([]byte("HTTP/1.1 204 No Content\r\n\r\n"))
+		c.Close()
+	}()
+
+	acct, _ := NewAccounting(&AccountingConfig{Dests: 8})
+	rep, r := sniffSession(t, &Options{Accounting: acct},
+		ln.Addr().(*net.TCPAddr), "Www.Example.com:80")
+	if rep != REP_SUCCESS || r.Rep != REP_SUCCESS {
+		t.Fatalf("reply %d, access record %+v", rep, r)
+	}
+
+	dests := acct.Stats()[""].Dests
+	if d := dests["www.example.com"]; d == nil || d.Up == 0 || d.Down == 0 {
+		t.Fatalf("dests %v", dests)
+	}
+	if d := dests["127.0.0.1"]; d != nil {
+		t.Fatalf("counted under the ip: %+v", d)
+	}
+}
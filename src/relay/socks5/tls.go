@@ -0,0 +1,62 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"relay"
+)
+
+// TLSConfig describes the tls side of a listener or of an upstream
+// server, files are pem encoded.
+type TLSConfig struct {
+	// required on a listener, on a client only for mutual tls
+	Cert string `json:"cert,omitempty"`
+	Key  string `json:"key,omitempty"`
+
+	// cas verifying the peer certificate, on a listener the client
+	// certificates, on a client the server certificate, where the system
+	// pool is used when empty
+	CA string `json:"ca,omitempty"`
+
+	// listener only, reject clients without a certificate signed by CA,
+	// otherwise a certificate is verified when given
+	ClientAuth bool `json:"client_auth,omitempty"`
+
+	// client only, name verified in the server certificate, the host of
+	// the server address when empty
+	ServerName string `json:"server_name,omitempty"`
+	Insecure   bool   `json:"insecure,omitempty"`
+}
+
+// ServerConfig loads the certificates of a listener.
+func (c *TLSConfig) ServerConfig() (*tls.Config, error) {
+	if c.Cert == "" || c.Key == "" || (c.ClientAuth && c.CA == "") {
+		return nil, ErrTLSConfig
+	}
+	return relay.ServerTLSConfig(c.Cert, c.Key, c.CA, c.ClientAuth)
+}
+
+// ClientConfig loads the certificates to connect to an upstream server.
+func (c *TLSConfig) ClientConfig() (conf *tls.Config, err error) {
+	if conf, err = relay.ClientTLSConfig(c.Cert, c.Key, c.CA); err != nil {
+		return
+	}
+	conf.ServerName = c.ServerName
+	conf.InsecureSkipVerify = c.Insecure
+	return
+}
+
+// stageTLS completes the tls handshake, the common name of a verified
+// client certificate is the user, and no other authentication is asked.
+func (h *TCPHandler) stageTLS() (err error) {
+	c, ok := h.conn.(*tls.Conn)
+	if !ok {
+		return
+	}
+	if err = c.Handshake(); err != nil {
+		return
+	}
+	if chains := c.ConnectionState().VerifiedChains; len(chains) > 0 {
+		h.req.User = chains[0][0].Subject.CommonName
+	}
+	return
+}
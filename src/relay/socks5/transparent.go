@@ -0,0 +1,51 @@
+package socks5
+
+import (
+	"context"
+	"net"
+)
+
+const (
+	// connections redirected by iptables REDIRECT or DNAT, the original
+	// destination is kept by conntrack
+	TRANSPARENT_REDIRECT = "redirect"
+
+	// connections diverted by iptables TPROXY to a listener made by
+	// ListenTProxy, the local address is the original destination
+	TRANSPARENT_TPROXY = "tproxy"
+)
+
+// ListenTProxy listens on a tcp socket with IP_TRANSPARENT set, which
+// accepts connections to any address, it needs CAP_NET_ADMIN.
+func ListenTProxy(network, addr string) (net.Listener, error) {
+	control, err := transparentControl()
+	if err != nil {
+		return nil, err
+	}
+	lc := &net.ListenConfig{Control: control}
+	return lc.Listen(context.Background(), network, addr)
+}
+
+// stageTransparent takes the destination of a transparent connection as
+// the request of a CONNECT, there is no socks handshake.
+func (h *TCPHandler) stageTransparent() (err error) {
+	local, _ := h.conn.LocalAddr().(*net.TCPAddr)
+	if local == nil {
+		return ErrNoOriginalDst
+	}
+
+	dst := local
+	if h.opt.Transparent == TRANSPARENT_REDIRECT {
+		if dst, err = originalDst(h.conn, local); err != nil {
+			return
+		}
+		// connected to the listener itself, dialing it again would loop
+		if dst.IP.Equal(local.IP) && dst.Port == local.Port {
+			return ErrNoOriginalDst
+		}
+	}
+
+	h.req.Command = CMD_CONNECT
+	h.req.Host, h.req.Port = dst.IP.String(), uint16(dst.Port)
+	return h.connect(false)
+}
@@ -0,0 +1,84 @@
+//go:build linux
+// +build linux
+
+package socks5
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// linux/netfilter_ipv4.h, IP6T_SO_ORIGINAL_DST has the same value
+	_SO_ORIGINAL_DST = 80
+
+	_IPV6_TRANSPARENT = 75
+)
+
+// originalDst asks conntrack for the destination of a redirected
+// connection.
+func originalDst(conn net.Conn, local *net.TCPAddr) (
+	addr *net.TCPAddr, err error) {
+	c, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, ErrNoOriginalDst
+	}
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return
+	}
+
+	level := syscall.SOL_IP
+	if local.IP.To4() == nil {
+		level = syscall.SOL_IPV6
+	}
+
+	// large enough for a sockaddr_in6
+	var sa [28]byte
+	e := raw.Control(func(fd uintptr) {
+		l := uint32(len(sa))
+		_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd,
+			uintptr(level), _SO_ORIGINAL_DST,
+			uintptr(unsafe.Pointer(&sa[0])), uintptr(unsafe.Pointer(&l)), 0)
+		if errno != 0 {
+			err = errno
+		}
+	})
+	if e != nil {
+		return nil, e
+	} else if err != nil {
+		return nil, ErrNoOriginalDst
+	}
+
+	// the family is in host order, the port in network order
+	addr = &net.TCPAddr{Port: int(binary.BigEndian.Uint16(sa[2:4]))}
+	switch *(*uint16)(unsafe.Pointer(&sa[0])) {
+	case syscall.AF_INET:
+		addr.IP = net.IP(append([]byte{}, sa[4:8]...))
+	case syscall.AF_INET6:
+		addr.IP = net.IP(append([]byte{}, sa[8:24]...))
+	default:
+		return nil, ErrNoOriginalDst
+	}
+	return
+}
+
+func transparentControl() (
+	func(network, address string, c syscall.RawConn) error, error) {
+	return func(network, address string, c syscall.RawConn) (err error) {
+		e := c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP,
+				syscall.IP_TRANSPARENT, 1)
+			if err == nil && network == "tcp6" {
+				err = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6,
+					_IPV6_TRANSPARENT, 1)
+			}
+		})
+		if e != nil {
+			return e
+		}
+		return
+	}, nil
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package socks5
+
+import (
+	"net"
+	"syscall"
+)
+
+func originalDst(conn net.Conn, local *net.TCPAddr) (*net.TCPAddr, error) {
+	return nil, ErrTransparent
+}
+
+func transparentControl() (
+	func(network, address string, c syscall.RawConn) error, error) {
+	return nil, ErrTransparent
+}
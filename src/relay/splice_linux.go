@@ -0,0 +1,88 @@
+//go:build linux
+// +build linux
+
+package relay
+
+import (
+	"net"
+	"syscall"
+)
+
+const (
+	_SPLICE_F_MOVE     = 0x01
+	_SPLICE_F_NONBLOCK = 0x02
+
+	_SPLICE_CHUNK = 1 << 20
+)
+
+// spliceCopy moves data from src to dst through a pipe without copying it
+// to user space, handled is false when src or dst is not a tcp connection.
+func spliceCopy(dst, src net.Conn, r *relayer, dir int) (
+	written int64, handled bool, err error) {
+	srcTCP, ok0 := src.(*net.TCPConn)
+	dstTCP, ok1 := dst.(*net.TCPConn)
+	if !ok0 || !ok1 {
+		return 0, false, nil
+	}
+
+	srcRaw, err := srcTCP.SyscallConn()
+	if err != nil {
+		return 0, false, nil
+	}
+	dstRaw, err := dstTCP.SyscallConn()
+	if err != nil {
+		return 0, false, nil
+	}
+
+	var p [2]int
+	if err = syscall.Pipe2(p[:],
+		syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		return 0, false, nil
+	}
+	defer syscall.Close(p[0])
+	defer syscall.Close(p[1])
+
+	for {
+		var (
+			n  int64
+			se error
+		)
+		r.setReadDeadline(src)
+		err = srcRaw.Read(func(fd uintptr) bool {
+			n, se = syscall.Splice(int(fd), nil, p[1], nil, _SPLICE_CHUNK,
+				_SPLICE_F_MOVE|_SPLICE_F_NONBLOCK)
+			return se != syscall.EAGAIN
+		})
+		if err == nil {
+			err = se
+		}
+		if err != nil {
+			if r.idle(err) {
+				return written, true, ErrIdleTimeout
+			} else if r.isTimeout(err) {
+				continue
+			}
+			return written, true, err
+		} else if n == 0 {
+			return written, true, nil
+		}
+
+		r.moved(dir, int(n))
+		for n > 0 {
+			var m int64
+			err = dstRaw.Write(func(fd uintptr) bool {
+				m, se = syscall.Splice(p[0], nil, int(fd), nil, int(n),
+					_SPLICE_F_MOVE|_SPLICE_F_NONBLOCK)
+				return se != syscall.EAGAIN
+			})
+			if err == nil {
+				err = se
+			}
+			if err != nil {
+				return written, true, err
+			}
+			n -= m
+			written += m
+		}
+	}
+}
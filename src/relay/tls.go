@@ -0,0 +1,67 @@
+package relay
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+)
+
+var ErrTLSCertPool = errors.New("relay: no certificate in pem file")
+
+// LoadCertPool reads the pem encoded certificates of file.
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, ErrTLSCertPool
+	}
+	return pool, nil
+}
+
+// ServerTLSConfig loads the certificate of a listener. With ca, client
+// certificates signed by it are verified when given, or required when
+// clientAuth is true.
+func ServerTLSConfig(cert, key, ca string, clientAuth bool) (
+	conf *tls.Config, err error) {
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return
+	}
+	conf = &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if ca != "" {
+		if conf.ClientCAs, err = LoadCertPool(ca); err != nil {
+			return nil, err
+		}
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+		if clientAuth {
+			conf.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return
+}
+
+// ClientTLSConfig loads the client certificate, when given, and the cas
+// verifying the server, the system pool when ca is empty.
+func ClientTLSConfig(cert, key, ca string) (conf *tls.Config, err error) {
+	conf = &tls.Config{MinVersion: tls.VersionTLS12}
+	if cert != "" || key != "" {
+		var pair tls.Certificate
+		if pair, err = tls.LoadX509KeyPair(cert, key); err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{pair}
+	}
+	if ca != "" {
+		if conf.RootCAs, err = LoadCertPool(ca); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
@@ -36,6 +36,9 @@ function build_tunnel_req() {
         "${MASTER_ADDR}/tunnel"
 }
 
+# tunnel of the master config, built on join
+echo ">> config" | nc 127.0.0.1 3802 -q 0
+
 build_tunnel_req
 echo ">> hello" | nc 127.0.0.1 3800 -q 0
 echo ">> world" | nc 127.0.0.1 3800 -q 0